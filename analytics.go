@@ -0,0 +1,309 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/taskqueue"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Errors from the asynchronous event sinks
+var (
+	ErrorEventQueueFull  = errors.New("Analytics queue is full, event dropped")
+	ErrorEventSinkClosed = errors.New("Analytics sink is closed")
+)
+
+// Batches of the asynchronous sink of the standalone server: events are
+// sent once there are EventBatchSize of them, or once the oldest one
+// waited EventBatchAge. At most EventQueueSize events wait while a batch
+// is sent, the others being dropped. Failed batches are sent again up to
+// EventMaxAttempts times, waiting between EventMinBackoff and
+// EventMaxBackoff. On App Engine, the cron job leases batches of
+// EventBatchSize events for EventLeaseTime, at most EventLeaseBatches
+// of them per run.
+const (
+	EventBatchSize    = 100
+	EventBatchAge     = 5 * time.Second
+	EventQueueSize    = 10000
+	EventMaxAttempts  = 8
+	EventMinBackoff   = time.Second
+	EventMaxBackoff   = 5 * time.Minute
+	EventLeaseTime    = time.Minute
+	EventLeaseBatches = 50
+)
+
+// Pull queue of the events waiting to be sent to BigQuery on App Engine,
+// declared in queue.yaml
+const AnalyticsQueue = "analytics-events"
+
+// Return how long to wait before sending a batch again after the
+// attempt failed: an exponential backoff from EventMinBackoff, capped
+// at EventMaxBackoff, of which a random half is waited so the instances
+// don't all retry at once
+func EventRetryDelay(attempt int) time.Duration {
+	d := EventMinBackoff
+	for i := 1; i < attempt && d < EventMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > EventMaxBackoff {
+		d = EventMaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Sink buffering the events in memory and sending them in batches to
+// another sink from a goroutine, so a slow or failing sink never slows
+// down or fails the games. Events still buffered when the process stops
+// without closing the sink are lost. Only for the standalone server:
+// the go1 runtime of App Engine doesn't keep goroutines running after
+// the requests, so the events are batched by TaskQueueSink there.
+type AsyncEventSink struct {
+	c         context.Context
+	sink      EventSink
+	batchSize int
+	batchAge  time.Duration
+
+	// Lock of the events channel, closed with the sink
+	mutex   sync.RWMutex
+	closed  bool
+	events  chan EventBatch
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// Return a sink sending the events to sink in batches of batchSize
+// events at most batchAge old, with the context c which must outlive the
+// requests (e.g. appengine.BackgroundContext)
+func NewAsyncEventSink(c context.Context, sink EventSink, batchSize int, batchAge time.Duration) *AsyncEventSink {
+	s := &AsyncEventSink{
+		c:         c,
+		sink:      sink,
+		batchSize: batchSize,
+		batchAge:  batchAge,
+		events:    make(chan EventBatch, EventQueueSize),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *AsyncEventSink) SendPlay(c context.Context, e PlayEvent) error {
+	return s.SendBatch(c, EventBatch{Plays: []PlayEvent{e}})
+}
+
+func (s *AsyncEventSink) SendGame(c context.Context, e GameEvent) error {
+	return s.SendBatch(c, EventBatch{Games: []GameEvent{e}})
+}
+
+// Queue the events of a batch without waiting, or return an error if
+// the queue is full
+func (s *AsyncEventSink) SendBatch(c context.Context, b EventBatch) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return ErrorEventSinkClosed
+	}
+	select {
+	case s.events <- b:
+		return nil
+	default:
+		return ErrorEventQueueFull
+	}
+}
+
+// Send the events queued, without waiting to send a failed batch again,
+// and close the sink it sends to if it can be closed
+func (s *AsyncEventSink) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.closing)
+	close(s.events)
+	s.mutex.Unlock()
+
+	<-s.done
+	if closer, ok := s.sink.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Gather the events queued in batches and send them, until closed
+func (s *AsyncEventSink) run() {
+	defer close(s.done)
+	var batch EventBatch
+	var flush <-chan time.Time
+	send := func() {
+		if batch.Len() > 0 {
+			s.send(batch)
+		}
+		batch = EventBatch{}
+		flush = nil
+	}
+	for {
+		select {
+		case b, ok := <-s.events:
+			if !ok {
+				send()
+				return
+			}
+			if batch.Len() == 0 {
+				flush = time.After(s.batchAge)
+			}
+			batch.Plays = append(batch.Plays, b.Plays...)
+			batch.Games = append(batch.Games, b.Games...)
+			if batch.Len() >= s.batchSize {
+				send()
+			}
+		case <-flush:
+			send()
+		}
+	}
+}
+
+// Send a batch, again after a backoff while it fails, up to
+// EventMaxAttempts times or until the sink is closed
+func (s *AsyncEventSink) send(b EventBatch) {
+	for attempt := 1; ; attempt++ {
+		err := s.sink.SendBatch(s.c, b)
+		if err == nil {
+			return
+		}
+		if attempt == EventMaxAttempts {
+			logger.Errorf(s.c, "Error while sending %v events, dropped after %v attempts: %v", b.Len(), attempt, err)
+			return
+		}
+		wait := EventRetryDelay(attempt)
+		logger.Warningf(s.c, "Error while sending %v events, trying again in %v: %v", b.Len(), wait, err)
+		select {
+		case <-time.After(wait):
+		case <-s.closing:
+			logger.Errorf(s.c, "Error while sending %v events, dropped as the sink is closed: %v", b.Len(), err)
+			return
+		}
+	}
+}
+
+// Sink adding the events to a pull queue of App Engine, from which the
+// analytics cron job leases them in batches to send them to BigQuery out
+// of the requests (see Flush). Adding a task to a pull queue only stores
+// it, so the requests don't each run a task sending a single event.
+type TaskQueueSink struct {
+	Queue string
+}
+
+func (s TaskQueueSink) SendPlay(c context.Context, e PlayEvent) error {
+	return s.SendBatch(c, EventBatch{Plays: []PlayEvent{e}})
+}
+
+func (s TaskQueueSink) SendGame(c context.Context, e GameEvent) error {
+	return s.SendBatch(c, EventBatch{Games: []GameEvent{e}})
+}
+
+func (s TaskQueueSink) SendBatch(c context.Context, b EventBatch) error {
+	payload, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	_, err = taskqueue.Add(c, &taskqueue.Task{Method: "PULL", Payload: payload}, s.Queue)
+	return err
+}
+
+// Lease the events of the queue in batches of EventBatchSize tasks and
+// send them to sink, until the queue is empty, EventLeaseBatches batches
+// were sent or a batch failed. The tasks of a failed batch are leased
+// again after a backoff, and dropped once leased more than
+// EventMaxAttempts times. Return the number of events sent.
+func (s TaskQueueSink) Flush(c context.Context, sink EventSink) (int, error) {
+	sent := 0
+	for i := 0; i < EventLeaseBatches; i++ {
+		tasks, err := taskqueue.Lease(c, EventBatchSize, s.Queue, int(EventLeaseTime/time.Second))
+		if err != nil {
+			return sent, err
+		}
+		if len(tasks) == 0 {
+			return sent, nil
+		}
+
+		var batch EventBatch
+		attempt := 0
+		for _, task := range tasks {
+			var b EventBatch
+			if err := json.Unmarshal(task.Payload, &b); err != nil {
+				logger.Errorf(c, "Error, dropped task %v of invalid events: %v", task.Name, err)
+				continue
+			}
+			if int(task.RetryCount) > EventMaxAttempts {
+				logger.Errorf(c, "Error, dropped %v events after %v attempts", b.Len(), task.RetryCount-1)
+				continue
+			}
+			batch.Plays = append(batch.Plays, b.Plays...)
+			batch.Games = append(batch.Games, b.Games...)
+			if int(task.RetryCount) > attempt {
+				attempt = int(task.RetryCount)
+			}
+		}
+
+		if batch.Len() > 0 {
+			if err := sink.SendBatch(c, batch); err != nil {
+				wait := EventRetryDelay(attempt)
+				logger.Warningf(c, "Error while sending %v events, trying again in %v: %v", batch.Len(), wait, err)
+				for _, task := range tasks {
+					if err := taskqueue.ModifyLease(c, task, s.Queue, int(wait/time.Second)); err != nil {
+						logger.Errorf(c, "Error while delaying task %v: %v", task.Name, err)
+					}
+				}
+				return sent, err
+			}
+		}
+		if err := taskqueue.DeleteMulti(c, tasks, s.Queue); err != nil {
+			return sent, err
+		}
+		sent += batch.Len()
+	}
+	return sent, nil
+}
+
+// Handler of the analytics cron job, sending the events queued by the
+// sink of the application to BigQuery
+// Return the number of events sent in HTTP response
+func SendEventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Send Events Handler")
+
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		logger.Errorf(c, "Error, not a cron request")
+		http.Error(w, "Error, forbidden", http.StatusForbidden)
+		return
+	}
+
+	sink, ok := eventSink.(TaskQueueSink)
+	if !ok {
+		logger.Errorf(c, "Error, events not queued in a task queue")
+		http.Error(w, "Internal Server Error: events not queued", http.StatusInternalServerError)
+		return
+	}
+	sent, err := sink.Flush(c, BigQuerySink{Dataset: BigQueryDataset})
+	if err != nil {
+		logger.Errorf(c, "Error while sending events after %v of them: %v", sent, err)
+		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Infof(c, "Sent %v events", sent)
+	fmt.Fprint(w, sent)
+
+}
@@ -5,7 +5,21 @@ function($scope, $http, $timeout) {
 	console.log(">>> MyController");
 
 	$scope.server_play = "";
+	$scope.commitment = "";
+	$scope.verified = false;
 	$scope.user_play = "";
+	$scope.level = DIFFICULTY;
+	$scope.rules_name = RULES;
+	$scope.rules = {};
+	$scope.rule_set_name = RULE_SET;
+	$scope.moves = [];
+	$scope.game_id = "";
+	$scope.mode = "bot";
+	$scope.match_id = "";
+	$scope.round = 0;
+	$scope.version = -1;
+	$scope.seconds_left = 0;
+	$scope.opponent_ready = false;
 
 	$scope.Reset = function() {
 		$scope.play_status="question";
@@ -14,43 +28,68 @@ function($scope, $http, $timeout) {
 		$scope.deuce = 0;		
 		$scope.user_plays = "";
 		$scope.server_plays = "";
+		$scope.server_play = "";
+		$scope.commitment = "";
+		$scope.user_play = "";
+		if ($scope.mode == "pvp") {
+			$scope.JoinMatch();
+		} else {
+			$scope.StartGame();
+		}
 	}
-	$scope.Reset();
 
-	$scope.RecordGame = function(winner) {
-		var url = '/game?';
+	$scope.StartGame = function() {
+		console.log(">>> Start");
+
+		var url = '/start?';
 		url += 'id=' +  COOKIE_ID;
+		url += '&level=' +  $scope.level;
+		url += '&rules=' +  $scope.rules_name;
+		url += '&ruleset=' +  $scope.rule_set_name;
+		console.log("Calling ", url);
 
-		$http.post(url, {
-			winner: winner,
-			user: $scope.user_plays,
-			server: $scope.server_plays,
+		$http.post(url)
+		.success(function(data) {
+			$scope.game_id = data.id;
+			$scope.rules = data.rules;
+			$scope.moves = $scope.GetMoves(data.rule_set);
+			$scope.GetServerPlay();
 		})
-		.success(function(data) {					
-			console.log("Game recorded...")                
-        })
         .error(function(errorMessage, errorCode, errorThrown) {
-            console.log("Error recording game: ", errorMessage);
+            console.log("Error starting game: ", errorMessage);
+            alert(errorMessage);
         });
 	}
 
+	// A tournament match is opened from its link (match parameter)
+	var match_param = /[?&]match=(\d+)/.exec(window.location.search);
+	if (match_param) {
+		$scope.mode = "pvp";
+		$timeout(function() {
+			$scope.OpenMatch(match_param[1]);
+		});
+	} else {
+		$scope.Reset();
+	}
+
 	$scope.setDelayedReset = function() {
 		$timeout(function() {
 			$scope.Reset();			
 		}, 3000);
 	}
 
+	// The server only sends the commitment to its play (SHA-256 hash of
+	// "play:nonce"), the play is revealed once the user played
 	$scope.GetServerPlay = function() {
 		console.log(">>> Play");
 
 		var url = '/play?';
-		url += 'pu=' +  $scope.user_plays;
-		url += '&ps=' +  $scope.server_plays;
+		url += 'g=' +  $scope.game_id;
 		console.log("Calling ", url);
 
 		$http.get(url)
         .success(function(data) {            
-            $scope.server_play = data;
+            $scope.commitment = data;
             $scope.Play();
         })
         .error(function(errorMessage, errorCode, errorThrown) {
@@ -58,7 +97,6 @@ function($scope, $http, $timeout) {
             alert(errorMessage);
         });
     };
-    $scope.GetServerPlay();
 
     var iterQuestion = 0;
 	$scope.setDelayedQuestion = function() {		
@@ -69,18 +107,22 @@ function($scope, $http, $timeout) {
 		} else if (iterQuestion<7) {
 			delay = 2500;
 		}
-		if ($scope.CheckIfFinish() == false) {
-			$timeout(function() {
-				$scope.play_status="question";
-				$scope.server_play = "";
-				$scope.user_play = "";
-				$scope.GetServerPlay();
-			}, delay);
+		if ($scope.mode == "pvp") {
+			delay = 1500;
 		}
+		$timeout(function() {
+			$scope.play_status="question";
+			$scope.server_play = "";
+			$scope.commitment = "";
+			$scope.user_play = "";
+			if ($scope.mode != "pvp") {
+				$scope.GetServerPlay();
+			}
+		}, delay);
 	}
 
 	$scope.Play = function() {
-		if ($scope.server_play == "") {
+		if ($scope.commitment == "") {
 			console.log("Waiting server answer...");
 			return
 		}
@@ -90,87 +132,356 @@ function($scope, $http, $timeout) {
 			return
 		}
 
-		$scope.play_status="question";
-		if ($scope.server_play == $scope.user_play) {
-			$scope.play_status="deuce";
-			$scope.deuce++;
-			$scope.setDelayedQuestion();			
-		} else if (
-			(($scope.server_play == "rock")  && ($scope.user_play == "scissor")) ||
-			(($scope.server_play == "paper")  && ($scope.user_play == "rock")) ||
-			(($scope.server_play == "scissor")  && ($scope.user_play == "paper")) 
-		) {
-			$scope.play_status="server";
-			$scope.server_wins++;
-			$scope.setDelayedQuestion();
-		} else if (
-			(($scope.user_play == "rock")  && ($scope.server_play == "scissor")) ||
-			(($scope.user_play == "paper")  && ($scope.server_play == "rock")) ||
-			(($scope.user_play == "scissor")  && ($scope.server_play == "paper"))
-		) {
-			$scope.play_status="user";
-			$scope.user_wins++;
-			$scope.setDelayedQuestion();
-		} else {
-			$scope.play_status="unkown";
-			console.log("Error: unkown game status with", $scope.user_play, $scope.server_play);
-            alert("Error: unkown game status with " + $scope.user_play + " and " + $scope.server_play);
-            return
-		}
+		// The server decides the winner of the round and of the game
+		$scope.play_status="waiting";
 
 		var url = '/record?';
-		url += 'id=' +  COOKIE_ID;
+		url += 'g=' +  $scope.game_id;
 		url += '&u=' +  $scope.user_play;
-		url += '&s=' +  $scope.user_play;
-		url += '&pu=' +  $scope.user_plays;
-		url += '&ps=' +  $scope.server_plays;
 		console.log("Calling ", url);
 
 		$http.get(url)
         .success(function(data) {
             console.log("Play recorded...")                
+            $scope.Verify(data.reveal);
+            $scope.UpdateGame(data);
         })
         .error(function(errorMessage, errorCode, errorThrown) {
             console.log("Error recording play: ", errorMessage);
+            alert(errorMessage);
         });
+	}
+
+	// Check the play revealed by the server matches its commitment
+	$scope.Verify = function(reveal) {
+		$scope.server_play = reveal.play;
+		$scope.verified = false;
+		var commitment = $scope.commitment;
+		var data = new TextEncoder().encode(reveal.play + ":" + reveal.nonce);
+		window.crypto.subtle.digest("SHA-256", data).then(function(hash) {
+			var hex = Array.prototype.map.call(new Uint8Array(hash), function(b) {
+				return ("0" + b.toString(16)).slice(-2);
+			}).join("");
+			$scope.$apply(function() {
+				$scope.verified = (hex == commitment);
+			});
+			if (hex != commitment) {
+				console.log("Error: server play", reveal.play, "does not match commitment", commitment);
+				alert("Error: the server play does not match its commitment!");
+			}
+		});
+	}
 
-        $scope.user_plays += $scope.user_play.charAt(0);
-        $scope.server_plays += $scope.server_play.charAt(0);		
+	$scope.UpdateGame = function(game) {
+		$scope.user_wins = game.user_wins;
+		$scope.server_wins = game.server_wins;
+		$scope.deuce = game.draws;
+		$scope.user_plays = game.user_plays;
+		$scope.server_plays = game.server_plays;
 
+		if (game.finished) {
+			$scope.play_status = game.winner + "_won";
+			$scope.setDelayedReset();
+		} else {
+			$scope.play_status = game.last_winner;
+			$scope.setDelayedQuestion();
+		}
 	}
 	
-	$scope.Rock = function() {
-		console.log("Rock");
-		$scope.user_play = "rock";			
-		$scope.Play();
+	$scope.GetMoves = function(rule_set_name) {
+		for (var i = 0; i < RULE_SETS.length; i++) {
+			if (RULE_SETS[i].name == rule_set_name) {
+				return RULE_SETS[i].moves;
+			}
+		}
+		return RULE_SETS[0].moves;
 	};
 
-	$scope.Paper = function() {
-		console.log("Paper");
-		$scope.user_play = "paper";			
+	$scope.Choose = function(move) {
+		console.log("Choose", move);
+		$scope.user_play = move;			
+		if ($scope.mode == "pvp") {
+			$scope.PlayMove(move);
+			return;
+		}
 		$scope.Play();
 	};
 
-	$scope.Scissor = function() {
-		console.log("Scissor");
-		$scope.user_play = "scissor";			
-		$scope.Play();
+	$scope.SetMode = function(mode) {
+		console.log("Mode", mode);
+		$scope.mode = mode;
+		$scope.StopListening();
+		$scope.Reset();
 	};
 
-	$scope.CheckIfFinish = function() {
-		if ($scope.server_wins+$scope.user_wins+$scope.deuce < 7) return false;
-		if ($scope.server_wins == $scope.user_wins) return false;
-		if ($scope.server_wins > $scope.user_wins) {
-			$scope.play_status="server_won";			
-			$scope.RecordGame("server");
-			$scope.setDelayedReset();	
-		} else {
-			$scope.play_status="user_won";			
-			$scope.RecordGame("user");
-			$scope.setDelayedReset();	
+	$scope.SetLevel = function(level) {
+		console.log("Level", level);
+		$scope.level = level;
+		$scope.Reset();
+	};
+
+	$scope.SetRuleSet = function(rule_set_name) {
+		console.log("Rule set", rule_set_name);
+		$scope.rule_set_name = rule_set_name;
+		$scope.Reset();
+	};
+
+	$scope.SetRules = function(rules_name) {
+		console.log("Rules", rules_name);
+		$scope.rules_name = rules_name;
+		$scope.Reset();
+	};
+
+	// ================================ Player vs Player ===
+	// Both players play at the same time, the server resolves the round
+	// and pushes the match over a WebSocket, or by long polling when
+	// WebSockets are not available (e.g. on App Engine)
+	var socket = null;
+	var listener = 0;
+	var countdown = 0;
+
+	// The server waits a while for an opponent, ask again until paired
+	// with one, or with the computer if nobody came
+	$scope.JoinMatch = function() {
+		console.log(">>> Join");
+		$scope.StopListening();
+		$scope.play_status = "opponent";
+		var id = listener;
+
+		var url = '/pvp/join?';
+		url += 'id=' +  COOKIE_ID;
+		url += '&rules=' +  $scope.rules_name;
+		url += '&ruleset=' +  $scope.rule_set_name;
+		console.log("Calling ", url);
+
+		$http.post(url)
+		.success(function(data) {
+			if (id != listener) {
+				return;
+			}
+			if (data.waiting) {
+				$scope.JoinMatch();
+				return;
+			}
+			if (data.bot) {
+				console.log("No opponent found, playing the computer");
+				$scope.mode = "bot";
+				$scope.StartGame();
+				return;
+			}
+			$scope.match_id = data.match.id;
+			$scope.round = 0;
+			$scope.version = -1;
+			$scope.rules = data.match.rules;
+			$scope.moves = $scope.GetMoves(data.match.rule_set);
+			$scope.UpdateMatch(data.match);
+			$scope.Listen();
+		})
+        .error(function(errorMessage, errorCode, errorThrown) {
+            console.log("Error joining match: ", errorMessage);
+            alert(errorMessage);
+        });
+	}
+
+	// Open a match the player was scheduled in, e.g. in a tournament
+	$scope.OpenMatch = function(match_id) {
+		console.log(">>> Open", match_id);
+		$scope.StopListening();
+		$scope.play_status = "opponent";
+		$scope.match_id = match_id;
+		$scope.round = 0;
+		$scope.version = -1;
+		var id = listener;
+
+		var url = '/pvp/poll?';
+		url += 'm=' +  match_id;
+		url += '&id=' +  COOKIE_ID;
+		url += '&v=-1';
+		console.log("Calling ", url);
+
+		$http.get(url)
+		.success(function(data) {
+			if (id != listener) {
+				return;
+			}
+			$scope.rules = data.rules;
+			$scope.moves = $scope.GetMoves(data.rule_set);
+			$scope.UpdateMatch(data);
+			if (!data.finished) {
+				$scope.Listen();
+			}
+		})
+        .error(function(errorMessage, errorCode, errorThrown) {
+            console.log("Error opening match: ", errorMessage);
+            alert(errorMessage);
+        });
+	}
+
+	$scope.StopListening = function() {
+		listener++;
+		countdown++;
+		if (socket) {
+			socket.onclose = null;
+			socket.close();
+			socket = null;
+		}
+	}
+
+	$scope.Listen = function() {
+		var id = listener;
+		if (!window.WebSocket) {
+			$scope.Poll(id, $scope.version);
+			return;
+		}
+
+		var url = (window.location.protocol == "https:") ? "wss://" : "ws://";
+		url += window.location.host + '/pvp/ws?';
+		url += 'm=' +  $scope.match_id;
+		url += '&id=' +  COOKIE_ID;
+		console.log("Connecting ", url);
+
+		socket = new WebSocket(url);
+		socket.onmessage = function(event) {
+			var data = JSON.parse(event.data);
+			$scope.$apply(function() {
+				if (data.error) {
+					console.log("Error playing move: ", data.error);
+					return;
+				}
+				$scope.UpdateMatch(data);
+			});
+		};
+		socket.onclose = function() {
+			socket = null;
+			if (id == listener) {
+				console.log("No WebSocket, long polling...");
+				$scope.Poll(id, $scope.version);
+			}
+		};
+	}
+
+	$scope.Poll = function(id, version) {
+		if (id != listener) {
+			return;
+		}
+
+		var url = '/pvp/poll?';
+		url += 'm=' +  $scope.match_id;
+		url += '&id=' +  COOKIE_ID;
+		url += '&v=' +  version;
+
+		$http.get(url)
+        .success(function(data) {
+            if (id != listener) {
+                return;
+            }
+            $scope.UpdateMatch(data);
+            if (!data.finished) {
+                $scope.Poll(id, data.version);
+            }
+        })
+        .error(function(errorMessage, errorCode, errorThrown) {
+            console.log("Error polling match: ", errorMessage);
+            $timeout(function() {
+                $scope.Poll(id, version);
+            }, 2000);
+        });
+	}
+
+	$scope.PlayMove = function(move) {
+		$scope.play_status = "waiting";
+		if (socket && socket.readyState == WebSocket.OPEN) {
+			socket.send(JSON.stringify({move: move}));
+			return;
+		}
+
+		var url = '/pvp/move?';
+		url += 'm=' +  $scope.match_id;
+		url += '&id=' +  COOKIE_ID;
+		url += '&u=' +  move;
+		console.log("Calling ", url);
+
+		$http.post(url)
+        .success(function(data) {
+            $scope.UpdateMatch(data);
+        })
+        .error(function(errorMessage, errorCode, errorThrown) {
+            console.log("Error playing move: ", errorMessage);
+            alert(errorMessage);
+        });
+	}
+
+	// Show the match from the point of view of the player, the winners
+	// "a" and "b" becoming "user" and "server" like in the bot mode
+	$scope.UpdateMatch = function(match) {
+		if (match.version < $scope.version) {
+			return;
+		}
+		$scope.version = match.version;
+
+		var me = match[match.you];
+		var opponent = match[match.you == "a" ? "b" : "a"];
+		var perspective = function(winner) {
+			if (winner == match.you) {
+				return "user";
+			}
+			if (winner == "a" || winner == "b") {
+				return "server";
+			}
+			return winner;
+		};
+		$scope.user_wins = me.wins;
+		$scope.server_wins = opponent.wins;
+		$scope.deuce = match.draws;
+		$scope.user_plays = me.plays;
+		$scope.server_plays = opponent.plays;
+		$scope.opponent_ready = opponent.ready;
+		$scope.Countdown(match.seconds_left);
+
+		if (match.round > $scope.round) {
+			$scope.round = match.round;
+			$scope.user_play = $scope.GetMove(match.rule_set, me.plays.slice(-1));
+			$scope.server_play = $scope.GetMove(match.rule_set, opponent.plays.slice(-1));
+			if (match.finished) {
+				$scope.StopListening();
+				$scope.play_status = perspective(match.winner) + "_won";
+				if (!match.tournament) {
+					$scope.setDelayedReset();
+				}
+			} else {
+				$scope.play_status = perspective(match.last_winner);
+				$scope.setDelayedQuestion();
+			}
+		} else if ($scope.play_status == "opponent") {
+			$scope.play_status = "question";
+		}
+	}
+
+	$scope.Countdown = function(seconds) {
+		var id = ++countdown;
+		$scope.seconds_left = seconds;
+		var tick = function() {
+			$timeout(function() {
+				if (id != countdown || $scope.seconds_left <= 0) {
+					return;
+				}
+				$scope.seconds_left--;
+				tick();
+			}, 1000);
+		};
+		tick();
+	}
+
+	$scope.GetMove = function(rule_set_name, code) {
+		for (var i = 0; i < RULE_SETS.length; i++) {
+			if (RULE_SETS[i].name == rule_set_name) {
+				var j = RULE_SETS[i].codes.indexOf(code);
+				if (j >= 0) {
+					return RULE_SETS[i].moves[j];
+				}
+			}
 		}
-		return true;
+		return "nothing";
 	};
-	
 
 }]);
\ No newline at end of file
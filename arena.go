@@ -0,0 +1,399 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Most rounds of an arena game if the rules do not end games by
+// themselves, so two bots playing the same move forever still finish
+const ArenaMaxRounds = 100
+
+// Bot always playing rock (the first move if the rule set has no rock)
+type ConstantBot struct{}
+
+func (ConstantBot) Name() string {
+	return "always-rock"
+}
+
+func (ConstantBot) Play(c context.Context, round Round) (Decision, error) {
+	rs := round.RuleSet
+	move := rs.Move("r")
+	if move == "" {
+		move = rs.Moves[0]
+	}
+	return Decision{Play: move, Confidence: 1}, nil
+}
+
+// Bot cycling through the moves in order (rock, paper, scissor, ...)
+type CyclerBot struct{}
+
+func (CyclerBot) Name() string {
+	return "cycler"
+}
+
+func (CyclerBot) Play(c context.Context, round Round) (Decision, error) {
+	rs := round.RuleSet
+	return Decision{Play: rs.Moves[len(round.ServerPlays)%len(rs.Moves)], Confidence: 1}, nil
+}
+
+// Bot countering the most frequent move of its opponent in the game
+type FrequencyBeaterBot struct{}
+
+func (FrequencyBeaterBot) Name() string {
+	return "frequency-beater"
+}
+
+func (FrequencyBeaterBot) Play(c context.Context, round Round) (Decision, error) {
+	rs := round.RuleSet
+	freq := make(map[string]int)
+	for _, code := range round.UserPlays {
+		freq[string(code)]++
+	}
+	if len(freq) == 0 {
+		return rs.RandomDecision(), nil
+	}
+	d := rs.NewDistribution(freq)
+	return Decision{Play: rs.Counter(rs.MostLikely(d)), Distribution: d, Samples: len(round.UserPlays)}, nil
+}
+
+// Bot playing uniformly at random, the Nash equilibrium no bot can beat
+// in the long run
+type RandomBot struct{}
+
+func (RandomBot) Name() string {
+	return "random"
+}
+
+func (RandomBot) Play(c context.Context, round Round) (Decision, error) {
+	return round.RuleSet.RandomDecision(), nil
+}
+
+// Bot playing a de Bruijn sequence of moves of order Order, in which
+// every sequence of Order moves appears exactly once, so no context of
+// Order moves or less predicts the next move better than chance
+type DeBruijnBot struct {
+	Order int
+}
+
+func (b DeBruijnBot) Name() string {
+	return fmt.Sprintf("de-bruijn-%v", b.Order)
+}
+
+func (b DeBruijnBot) Play(c context.Context, round Round) (Decision, error) {
+	rs := round.RuleSet
+	sequence := DeBruijn(len(rs.Moves), b.Order)
+	return Decision{Play: rs.Moves[sequence[len(round.ServerPlays)%len(sequence)]], Confidence: 1}, nil
+}
+
+// Return the de Bruijn sequence of order n over k symbols (0 to k-1),
+// of length k^n, built from the Lyndon words in lexicographic order
+func DeBruijn(k, n int) []int {
+	var sequence []int
+	a := make([]int, k*n)
+	var db func(t, p int)
+	db = func(t, p int) {
+		if t > n {
+			if n%p == 0 {
+				sequence = append(sequence, a[1:p+1]...)
+			}
+			return
+		}
+		a[t] = a[t-p]
+		db(t+1, p)
+		for j := a[t-p] + 1; j < k; j++ {
+			a[t] = j
+			db(t+1, t)
+		}
+	}
+	db(1, 1)
+	return sequence
+}
+
+// Return the classic scripted bots to test strategies against
+func ScriptedBots() []Strategy {
+	return []Strategy{
+		ConstantBot{},
+		CyclerBot{},
+		FrequencyBeaterBot{},
+		RandomBot{},
+		DeBruijnBot{Order: 2},
+		DeBruijnBot{Order: 3},
+	}
+}
+
+// Results of a bot against another one in the arena
+type ArenaScore struct {
+	Wins   int `json:"wins"`
+	Draws  int `json:"draws"`
+	Losses int `json:"losses"`
+	Rounds int `json:"rounds"`
+}
+
+// Return the share of games won, counting draws as half a win
+func (s ArenaScore) Score() float64 {
+	games := s.Wins + s.Draws + s.Losses
+	if games == 0 {
+		return 0
+	}
+	return (float64(s.Wins) + float64(s.Draws)/2) / float64(games)
+}
+
+// Results of an arena: Matrix[i][j] is the score of bot i against bot
+// j, and Errors the number of plays of each bot that failed and were
+// replaced by a random play (e.g. strategies needing Datastore when run
+// outside of App Engine)
+type ArenaResult struct {
+	RuleSet string         `json:"rule_set"`
+	Rules   GameRules      `json:"rules"`
+	Games   int            `json:"games"`
+	Bots    []string       `json:"bots"`
+	Matrix  [][]ArenaScore `json:"matrix"`
+	Errors  map[string]int `json:"errors,omitempty"`
+}
+
+// Return the bots of the arena by overall score, the best first
+func (a *ArenaResult) Ranking() []string {
+	total := make(map[string]float64)
+	for i, bot := range a.Bots {
+		for j := range a.Bots {
+			if i != j {
+				total[bot] += a.Matrix[i][j].Score()
+			}
+		}
+	}
+	ranking := append([]string(nil), a.Bots...)
+	sort.SliceStable(ranking, func(i, j int) bool {
+		return total[ranking[i]] > total[ranking[j]]
+	})
+	return ranking
+}
+
+// Write the matrix of the arena as a text table of wins/draws/losses,
+// a row per bot
+func (a *ArenaResult) WriteTable(w io.Writer) {
+	width := 0
+	for _, bot := range a.Bots {
+		if len(bot) > width {
+			width = len(bot)
+		}
+	}
+	cell := len(fmt.Sprintf("%v/%v/%v", a.Games, a.Games, a.Games))
+	if cell < width {
+		cell = width
+	}
+
+	fmt.Fprintf(w, "%v games per pair, %v, %v (W/D/L of the row bot)\n\n", a.Games, a.RuleSet, a.Rules.Describe())
+	fmt.Fprintf(w, "%-*v", width, "")
+	for _, bot := range a.Bots {
+		fmt.Fprintf(w, "  %*v", cell, bot)
+	}
+	fmt.Fprintln(w)
+	for i, bot := range a.Bots {
+		fmt.Fprintf(w, "%-*v", width, bot)
+		for j := range a.Bots {
+			text := "-"
+			if i != j {
+				s := a.Matrix[i][j]
+				text = fmt.Sprintf("%v/%v/%v", s.Wins, s.Draws, s.Losses)
+			}
+			fmt.Fprintf(w, "  %*v", cell, text)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "\nRanking: %v\n", strings.Join(a.Ranking(), ", "))
+	for _, bot := range a.Bots {
+		if a.Errors[bot] > 0 {
+			fmt.Fprintf(w, "%v: %v plays failed and were played at random\n", bot, a.Errors[bot])
+		}
+	}
+}
+
+// Bot standing for a strategy which cannot play in the arena, failing
+// every play so it is played at random
+type failingBot struct {
+	Strategy
+	err error
+}
+
+func (b failingBot) Play(c context.Context, round Round) (Decision, error) {
+	return Decision{}, b.err
+}
+
+// Return the play of a bot, or an error if it failed or panicked, as
+// the Datastore functions do outside of App Engine
+func arenaPlay(c context.Context, s Strategy, round Round) (decision Decision, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Strategy %v panicked: %v", s.Name(), r)
+		}
+	}()
+	return s.Play(c, round)
+}
+
+// Return the bot, or a failing one if it fails its first play
+func probeBot(c context.Context, rs *RuleSet, s Strategy) Strategy {
+	if _, err := arenaPlay(c, s, Round{RuleSet: rs}); err != nil {
+		return failingBot{s, err}
+	}
+	return s
+}
+
+// Return the id of a bot as a player of the arena, under which its
+// plays are stored for the strategies learning from its past games
+func ArenaPlayerId(s Strategy) string {
+	return "arena:" + s.Name()
+}
+
+// Store the play of a round of a bot (the server) against another one
+// (the user) like the game does, and the outcome of the arm of a
+// bandit, so the strategies learning from the plays can play
+func recordArenaPlay(c context.Context, rs *RuleSet, server, user Strategy, decision Decision, userPlays, serverPlays string) error {
+	gamePlay := NewGamePlay(userPlays, serverPlays)
+	gamePlay.CookieId = ArenaPlayerId(user)
+	gamePlay.Strategy = decision.Strategy
+	gamePlay.RuleSet = rs.Name
+	if err := playStore.RecordPlay(c, rs, gamePlay); err != nil {
+		return err
+	}
+	return recordArmOutcome(c, playStore, rs, server, gamePlay.CookieId, decision, gamePlay.CurrentUserPlay, gamePlay.CurrentServerPlay)
+}
+
+// Count in store the outcome of a play decided by an arm of a bandit (the
+// server) against a known player, like the game does, so the bandit
+// learns which arm works against the player
+func recordArmOutcome(c context.Context, store PlayStore, rs *RuleSet, server Strategy, cookieId string, decision Decision, userPlay, serverPlay string) error {
+	if bandit, ok := server.(BanditStrategy); ok && cookieId != "" && bandit.HasArm(decision.Strategy) {
+		return store.RecordStrategyOutcome(c, rs, cookieId, decision.Strategy, userPlay, serverPlay)
+	}
+	return nil
+}
+
+// Play a game between two bots, each seeing the other as the user, and
+// return the winner ("user" for a, "server" for b, or "draw"), the
+// number of rounds, and the number of failed plays of each bot. The
+// plays of each round are stored in the play store from the point of
+// view of both bots.
+func PlayArenaGame(c context.Context, rs *RuleSet, rules GameRules, a, b Strategy) (string, int, int, int) {
+	if rules.MaxRounds == 0 {
+		rules.MaxRounds = ArenaMaxRounds
+	}
+	aPlays, bPlays := "", ""
+	aWins, bWins, draws := 0, 0, 0
+	aErrors, bErrors := 0, 0
+	play := func(s Strategy, round Round, errors *int) Decision {
+		decision, err := arenaPlay(c, s, round)
+		if err != nil || rs.Code(decision.Play) == "" {
+			*errors++
+			decision = rs.RandomDecision()
+		}
+		return decision
+	}
+	for {
+		aDecision := play(a, Round{RuleSet: rs, CookieId: ArenaPlayerId(b), UserPlays: bPlays, ServerPlays: aPlays}, &aErrors)
+		bDecision := play(b, Round{RuleSet: rs, CookieId: ArenaPlayerId(a), UserPlays: aPlays, ServerPlays: bPlays}, &bErrors)
+		aPlay, bPlay := rs.Code(aDecision.Play), rs.Code(bDecision.Play)
+		aPlays += aPlay
+		bPlays += bPlay
+		if err := recordArenaPlay(c, rs, a, b, aDecision, bPlays, aPlays); err != nil {
+			logger.Errorf(c, "Error while storing play of %v: %v", a.Name(), err)
+		}
+		if err := recordArenaPlay(c, rs, b, a, bDecision, aPlays, bPlays); err != nil {
+			logger.Errorf(c, "Error while storing play of %v: %v", b.Name(), err)
+		}
+		switch {
+		case rs.Beats(aPlay, bPlay):
+			aWins++
+		case rs.Beats(bPlay, aPlay):
+			bWins++
+		default:
+			draws++
+		}
+		if finished, winner := rules.Finished(aWins, bWins, draws); finished {
+			return winner, len(aPlays), aErrors, bErrors
+		}
+	}
+}
+
+// Pit every bot against every other one for a number of games, one game
+// after the other so the games of a seed are the same, and return the
+// results. Bots failing their first play are not asked again and play
+// at random.
+func RunArena(c context.Context, rs *RuleSet, rules GameRules, bots []Strategy, games int) *ArenaResult {
+	result := &ArenaResult{
+		RuleSet: rs.Name,
+		Rules:   rules,
+		Games:   games,
+		Matrix:  make([][]ArenaScore, len(bots)),
+		Errors:  make(map[string]int),
+	}
+	bots = append([]Strategy(nil), bots...)
+	for i, bot := range bots {
+		result.Bots = append(result.Bots, bot.Name())
+		result.Matrix[i] = make([]ArenaScore, len(bots))
+		bots[i] = probeBot(c, rs, bot)
+	}
+
+	for i := range bots {
+		for j := i + 1; j < len(bots); j++ {
+			var score ArenaScore
+			for g := 0; g < games; g++ {
+				winner, rounds, aErrors, bErrors := PlayArenaGame(c, rs, rules, bots[i], bots[j])
+				switch winner {
+				case "user":
+					score.Wins++
+				case "server":
+					score.Losses++
+				default:
+					score.Draws++
+				}
+				score.Rounds += rounds
+				result.Errors[result.Bots[i]] += aErrors
+				result.Errors[result.Bots[j]] += bErrors
+			}
+			result.Matrix[i][j] = score
+			result.Matrix[j][i] = ArenaScore{Wins: score.Losses, Draws: score.Draws, Losses: score.Wins, Rounds: score.Rounds}
+		}
+	}
+	for bot, n := range result.Errors {
+		if n == 0 {
+			delete(result.Errors, bot)
+		}
+	}
+	return result
+}
+
+// Return the bots named in a comma separated list, among the registered
+// strategies and the scripted bots, or all of them if names is ""
+func ArenaBots(names string) ([]Strategy, error) {
+	var all []Strategy
+	for _, name := range StrategyNames() {
+		all = append(all, strategies[name])
+	}
+	all = append(all, ScriptedBots()...)
+	if names == "" {
+		return all, nil
+	}
+
+	var bots []Strategy
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, bot := range all {
+			if bot.Name() == name {
+				bots = append(bots, bot)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown bot %v", name)
+		}
+	}
+	return bots, nil
+}
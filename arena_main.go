@@ -0,0 +1,64 @@
+// Rock Paper Scissors Game on App Engine
+
+//go:build arena
+// +build arena
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// Command pitting the server strategies and the scripted bots against
+// each other, outside of App Engine:
+//
+//	go run -tags arena . -games 1000 -rules best-of-5 -ruleset rpsls
+//
+// Plays are stored in memory, from an empty store, so the strategies
+// learning from the plays of all players (frequency) or of their
+// opponent (personal, bandit) learn along the games. Games are played
+// one after the other, so a seed always gives the same results.
+func main() {
+	games := flag.Int("games", 1000, "number of games per pair of bots")
+	rulesName := flag.String("rules", DefaultRulesName, "game rules")
+	ruleSetName := flag.String("ruleset", DefaultRuleSetName, "rule set")
+	names := flag.String("bots", "", "comma separated bots, all strategies and scripted bots if empty")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random seed")
+	asJSON := flag.Bool("json", false, "write the results in JSON")
+	verbose := flag.Bool("v", false, "write the logs of the strategies")
+	flag.Parse()
+	if !*verbose {
+		logger = NewStdLogger(ioutil.Discard)
+	}
+
+	rules, err := GetGameRules(*rulesName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v %v\n", err, *rulesName)
+		os.Exit(2)
+	}
+	ruleSet, err := GetRuleSet(*ruleSetName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v %v\n", err, *ruleSetName)
+		os.Exit(2)
+	}
+	bots, err := ArenaBots(*names)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	rand.Seed(*seed)
+	playStore = NewMemoryPlayStore()
+	result := RunArena(context.Background(), ruleSet, rules, bots, *games)
+	if *asJSON {
+		fmt.Println(ToJSON(result))
+		return
+	}
+	result.WriteTable(os.Stdout)
+}
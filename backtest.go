@@ -0,0 +1,262 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"strings"
+)
+
+// Errors from the backtest functions
+var (
+	ErrorInvalidRecord = errors.New("Invalid recorded play")
+)
+
+// Play of a human recorded in the BigQuery plays table or in a GamePlay
+// entity: the move of the user and of the server in a round, after the
+// plays of the game before it
+type RecordedPlay struct {
+	CookieId   string `json:"cookie_id,omitempty"`
+	RuleSet    string `json:"rule_set,omitempty"`
+	User       string `json:"user"`
+	Server     string `json:"server"`
+	LastUser   string `json:"last_user"`
+	LastServer string `json:"last_server"`
+}
+
+// Columns of a recorded play, by their names in the BigQuery plays table
+// then in the JSON of GamePlay entities
+var recordedColumns = map[string][]string{
+	"CookieId":   {"CookieId", "cookie_id"},
+	"RuleSet":    {"RuleSet", "rule_set"},
+	"User":       {"User", "current_user_play"},
+	"Server":     {"Server", "current_server_play"},
+	"LastUser":   {"LastUser", "last_user_play"},
+	"LastServer": {"LastServer", "last_server_play"},
+}
+
+// Return the recorded play of a row of an export, by column name
+func newRecordedPlay(row map[string]string) (RecordedPlay, error) {
+	get := func(column string) string {
+		for _, name := range recordedColumns[column] {
+			if value := row[name]; value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	play := RecordedPlay{
+		CookieId:   get("CookieId"),
+		RuleSet:    get("RuleSet"),
+		User:       get("User"),
+		Server:     get("Server"),
+		LastUser:   get("LastUser"),
+		LastServer: get("LastServer"),
+	}
+	if play.User == "" || len(play.LastUser) != len(play.LastServer) {
+		return play, ErrorInvalidRecord
+	}
+	return play, nil
+}
+
+// Read the recorded plays of an export of the plays table, of GamePlay
+// entities or of the jsonl analytics sink, as newline delimited JSON (the
+// BigQuery export format) or as CSV with a header row if csvFormat is set
+func ReadRecordedPlays(r io.Reader, csvFormat bool) ([]RecordedPlay, error) {
+	var plays []RecordedPlay
+	add := func(line int, row map[string]string) error {
+		play, err := newRecordedPlay(row)
+		if err != nil {
+			return fmt.Errorf("Line %v: %v", line, err)
+		}
+		plays = append(plays, play)
+		return nil
+	}
+
+	if csvFormat {
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(records); i++ {
+			row := make(map[string]string)
+			for j, name := range records[0] {
+				if j < len(records[i]) {
+					row[name] = records[i][j]
+				}
+			}
+			if err := add(i+1, row); err != nil {
+				return nil, err
+			}
+		}
+		return plays, nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var values map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &values); err != nil {
+			return nil, fmt.Errorf("Line %v: %v", line, err)
+		}
+		row := make(map[string]string)
+		for name, value := range values {
+			if s, ok := value.(string); ok {
+				row[name] = s
+			}
+		}
+
+		// Files of the jsonl analytics sink have games between plays
+		if eventType := row["Type"]; eventType != "" && eventType != "play" {
+			continue
+		}
+		if err := add(line, row); err != nil {
+			return nil, err
+		}
+	}
+	return plays, scanner.Err()
+}
+
+// Results of a strategy replayed against recorded plays: how often it
+// predicted the next move of the human (the most likely move of its
+// distribution), and how often its play would have beaten the human,
+// drawn or lost. Skipped plays are of unknown rule sets or moves, and
+// Errors plays where the strategy failed.
+type BacktestResult struct {
+	Strategy  string `json:"strategy"`
+	Plays     int    `json:"plays"`
+	Predicted int    `json:"predicted"`
+	Wins      int    `json:"wins"`
+	Draws     int    `json:"draws"`
+	Losses    int    `json:"losses"`
+	Skipped   int    `json:"skipped,omitempty"`
+	Errors    int    `json:"errors,omitempty"`
+}
+
+// Return the share of plays whose next move was predicted
+func (b BacktestResult) PredictionRate() float64 {
+	if b.Plays == 0 {
+		return 0
+	}
+	return float64(b.Predicted) / float64(b.Plays)
+}
+
+// Return the share of plays won minus the share of plays lost, 0 for
+// random play
+func (b BacktestResult) Edge() float64 {
+	if b.Plays == 0 {
+		return 0
+	}
+	return float64(b.Wins-b.Losses) / float64(b.Plays)
+}
+
+// Add the outcome of a play of the server against a play of the user
+func (b *BacktestResult) add(rs *RuleSet, server, user string) {
+	b.Plays++
+	switch {
+	case rs.Beats(server, user):
+		b.Wins++
+	case rs.Beats(user, server):
+		b.Losses++
+	default:
+		b.Draws++
+	}
+}
+
+// Return the recorded play as a GamePlay
+func (p RecordedPlay) GamePlay() GamePlay {
+	gamePlay := NewGamePlay(p.LastUser+p.User, p.LastServer+p.Server)
+	gamePlay.CookieId = p.CookieId
+	gamePlay.RuleSet = p.RuleSet
+	return gamePlay
+}
+
+// Return the rule set of a recorded play, classic for plays recorded
+// before rule sets existed, and nil if unknown or if the play has moves
+// outside of it
+func recordedRuleSet(play RecordedPlay) *RuleSet {
+	rs, err := GetRuleSet(play.RuleSet)
+	if err != nil {
+		return nil
+	}
+	for _, code := range play.User + play.LastUser + play.LastServer {
+		if rs.Index(string(code)) < 0 {
+			return nil
+		}
+	}
+	return rs
+}
+
+// Replay recorded plays through a strategy, each one from the plays of
+// the game before it, and return how it would have done. Each play is
+// then recorded in store if not nil, so strategies learning from the
+// plays of the store only know the plays before it, with the outcome of
+// the play of the strategy if it is a bandit, so it learns from its arms
+// like in the game. A strategy failing its first play is not asked
+// again.
+func Backtest(c context.Context, strategy Strategy, plays []RecordedPlay, store PlayStore) BacktestResult {
+	result := BacktestResult{Strategy: strategy.Name()}
+	strategy = probeBot(c, Classic, strategy)
+	for _, play := range plays {
+		rs := recordedRuleSet(play)
+		if rs == nil {
+			result.Skipped++
+			continue
+		}
+		decision, err := arenaPlay(c, strategy, Round{
+			RuleSet:     rs,
+			CookieId:    play.CookieId,
+			UserPlays:   play.LastUser,
+			ServerPlays: play.LastServer,
+		})
+		code := rs.Code(decision.Play)
+		if err != nil || code == "" {
+			result.Errors++
+		} else {
+			if rs.MostLikely(decision.Distribution) == play.User {
+				result.Predicted++
+			}
+			result.add(rs, code, play.User)
+		}
+		if store != nil {
+			store.RecordPlay(c, rs, play.GamePlay())
+			if err == nil && code != "" {
+				recordArmOutcome(c, store, rs, strategy, play.CookieId, decision, play.User, code)
+			}
+		}
+	}
+	return result
+}
+
+// Return how the plays actually made by the server did, to compare
+// strategies with
+func RecordedResult(plays []RecordedPlay) BacktestResult {
+	result := BacktestResult{Strategy: "recorded"}
+	for _, play := range plays {
+		rs := recordedRuleSet(play)
+		if rs == nil || rs.Index(play.Server) < 0 {
+			result.Skipped++
+			continue
+		}
+		result.add(rs, play.Server, play.User)
+	}
+	return result
+}
+
+// Write backtest results as a text table
+func WriteBacktestTable(w io.Writer, results []BacktestResult) {
+	fmt.Fprintf(w, "%-18v %8v %10v %8v %8v %8v %8v %8v\n", "strategy", "plays", "predicted", "wins", "draws", "losses", "edge", "errors")
+	for _, b := range results {
+		fmt.Fprintf(w, "%-18v %8v %9.1f%% %8v %8v %8v %+7.1f%% %8v\n",
+			b.Strategy, b.Plays, 100*b.PredictionRate(), b.Wins, b.Draws, b.Losses, 100*b.Edge(), b.Errors)
+	}
+}
@@ -0,0 +1,80 @@
+// Rock Paper Scissors Game on App Engine
+
+//go:build backtest
+// +build backtest
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// Command replaying the plays of an export of the BigQuery plays table
+// (newline delimited JSON or CSV) or of GamePlay entities through the
+// strategies, outside of App Engine:
+//
+//	go run -tags backtest . -bots markov,iocaine plays.json
+//
+// Plays are stored in memory as they are replayed, so the strategies
+// learning from the plays of all players (frequency, personal) know the
+// plays before the one replayed, and the bandit the outcomes of its arms
+// against the player before it.
+func main() {
+	names := flag.String("bots", "", "comma separated strategies, all strategies and scripted bots if empty")
+	csvFormat := flag.Bool("csv", false, "read CSV instead of newline delimited JSON (default for .csv files)")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random seed")
+	asJSON := flag.Bool("json", false, "write the results in JSON")
+	verbose := flag.Bool("v", false, "write the logs of the strategies")
+	flag.Parse()
+	if !*verbose {
+		logger = NewStdLogger(ioutil.Discard)
+	}
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: backtest [flags] plays.json|plays.csv|-")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var in io.Reader = os.Stdin
+	if name := flag.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+		*csvFormat = *csvFormat || strings.HasSuffix(name, ".csv")
+	}
+	plays, err := ReadRecordedPlays(in, *csvFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	bots, err := ArenaBots(*names)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	rand.Seed(*seed)
+	results := []BacktestResult{RecordedResult(plays)}
+	for _, bot := range bots {
+		store := NewMemoryPlayStore()
+		playStore = store
+		results = append(results, Backtest(context.Background(), bot, plays, store))
+	}
+	if *asJSON {
+		fmt.Println(ToJSON(results))
+		return
+	}
+	WriteBacktestTable(os.Stdout, results)
+}
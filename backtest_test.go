@@ -0,0 +1,41 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func TestBacktestBandit(t *testing.T) {
+	store := useMemoryPlayStore(t)
+	c := context.Background()
+
+	// A player always playing rock, and an anonymous one whose outcomes
+	// can't be counted
+	var plays []RecordedPlay
+	userPlays, serverPlays := "", ""
+	for i := 0; i < 30; i++ {
+		plays = append(plays, RecordedPlay{CookieId: "rock", RuleSet: "classic", User: "r", Server: "p", LastUser: userPlays, LastServer: serverPlays})
+		plays = append(plays, RecordedPlay{RuleSet: "classic", User: "p", Server: "p", LastUser: userPlays, LastServer: serverPlays})
+		userPlays, serverPlays = userPlays+"r", serverPlays+"p"
+	}
+	result := Backtest(c, GetStrategy("bandit"), plays, store)
+	if result.Errors != 0 || result.Plays != len(plays) {
+		t.Fatalf("Backtest = %+v, want %v plays without errors", result, len(plays))
+	}
+
+	stats, err := store.StrategyStats(c, "rock")
+	if err != nil {
+		t.Fatalf("StrategyStats: %v", err)
+	}
+	counted := 0
+	for _, s := range stats {
+		counted += s.Plays
+	}
+	if counted != 30 {
+		t.Errorf("Outcomes of %v plays counted for the arms, want 30: %+v", counted, stats)
+	}
+	if stats, _ := store.StrategyStats(c, ""); len(stats) != 0 {
+		t.Errorf("StrategyStats of anonymous players = %+v, want none", stats)
+	}
+}
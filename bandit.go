@@ -0,0 +1,176 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Structure to store in Datastore the results of a strategy against
+// a player, from the strategy point of view
+type StrategyStats struct {
+	CookieId    string    `json:"cookie_id"`
+	Strategy    string    `json:"strategy"`
+	Plays       int       `json:"plays"`
+	Wins        int       `json:"wins"`
+	Draws       int       `json:"draws"`
+	Losses      int       `json:"losses"`
+	UpdatedTime time.Time `json:"updated_time,omitempty"`
+}
+
+// Average reward of the strategy: 1 for a win, 0.5 for a draw and 0
+// for a loss
+func (s StrategyStats) Reward() float64 {
+	if s.Plays == 0 {
+		return 0
+	}
+	return (float64(s.Wins) + float64(s.Draws)/2) / float64(s.Plays)
+}
+
+// Count the outcome of a play/move of the strategy against the player
+func (s *StrategyStats) Add(rs *RuleSet, userPlay, serverPlay string) {
+	s.Plays++
+	switch {
+	case rs.Beats(serverPlay, userPlay):
+		s.Wins++
+	case rs.Beats(userPlay, serverPlay):
+		s.Losses++
+	default:
+		s.Draws++
+	}
+	s.UpdatedTime = time.Now()
+}
+
+// Return the Datastore key of the statistics of a strategy for a player
+func StrategyStatsKey(c context.Context, cookieId, strategy string) *datastore.Key {
+	return datastore.NewKey(c, "StrategyStats", cookieId+":"+strategy, 0, nil)
+}
+
+// Return the statistics of every strategy played against a player,
+// by strategy name
+func GetStrategyStats(c context.Context, cookieId string) (map[string]StrategyStats, error) {
+	var stats []StrategyStats
+	q := datastore.NewQuery("StrategyStats").Filter("CookieId =", cookieId)
+	if _, err := q.GetAll(c, &stats); err != nil {
+		return nil, err
+	}
+	result := make(map[string]StrategyStats)
+	for _, s := range stats {
+		result[s.Strategy] = s
+	}
+	return result, nil
+}
+
+// Record the outcome of a play/move of a strategy against a player in
+// a transaction
+func RecordStrategyOutcome(c context.Context, rs *RuleSet, cookieId, strategy, userPlay, serverPlay string) error {
+	key := StrategyStatsKey(c, cookieId, strategy)
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		stats := StrategyStats{CookieId: cookieId, Strategy: strategy}
+		if err := datastore.Get(tc, key, &stats); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		stats.Add(rs, userPlay, serverPlay)
+		_, err := datastore.Put(tc, key, &stats)
+		return err
+	}, nil)
+}
+
+// Function of the tasks recording the outcome of a play/move of a
+// strategy against a player, out of the request
+var recordStrategyOutcomeLater = delay.Func("record-strategy-outcome", func(c context.Context, ruleSetName, cookieId, strategy, userPlay, serverPlay string) error {
+	rs, err := GetRuleSet(ruleSetName)
+	if err != nil {
+		return err
+	}
+	return RecordStrategyOutcome(c, rs, cookieId, strategy, userPlay, serverPlay)
+})
+
+// Record the outcome of the play/move of a game against its player if
+// the game is played by a bandit and the play by one of its arms, as
+// the bandit only reads the outcomes of its arms against known players
+func RecordBanditOutcome(c context.Context, session *GameSession, gamePlay GamePlay) error {
+	bandit, ok := GetStrategy(session.Strategy).(BanditStrategy)
+	if !ok || session.Strategy != bandit.Name() || session.CookieId == "" || !bandit.HasArm(gamePlay.Strategy) {
+		return nil
+	}
+	return playStore.RecordStrategyOutcome(c, session.RuleSet(), session.CookieId, gamePlay.Strategy, gamePlay.CurrentUserPlay, gamePlay.CurrentServerPlay)
+}
+
+// Strategy picking, for each play/move, one of the Arms strategies with
+// the UCB1 multi-armed bandit algorithm on the results of each strategy
+// against the current player
+type BanditStrategy struct {
+	Arms []string
+}
+
+func init() {
+	RegisterStrategy(BanditStrategy{Arms: []string{"frequency", "markov", "iocaine", "personal"}})
+}
+
+func (BanditStrategy) Name() string {
+	return "bandit"
+}
+
+func (b BanditStrategy) Play(c context.Context, round Round) (Decision, error) {
+
+	// Get the results of each strategy against this player, none for
+	// unknown players
+	stats := make(map[string]StrategyStats)
+	if round.CookieId != "" {
+		var err error
+		if stats, err = playStore.StrategyStats(c, round.CookieId); err != nil {
+			return Decision{}, err
+		}
+	}
+
+	// Pick the arm and play with it, reporting the arm as the strategy
+	// so its outcome is recorded against it
+	arm := b.Select(stats)
+	logger.Debugf(c, "Bandit picked strategy %v", arm)
+	decision, err := GetStrategy(arm).Play(c, round)
+	if err != nil {
+		return Decision{}, err
+	}
+	decision.Strategy = arm
+	return decision, nil
+}
+
+// Return true if the strategy is one of the arms of the bandit
+func (b BanditStrategy) HasArm(strategy string) bool {
+	for _, arm := range b.Arms {
+		if arm == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the arm with the highest UCB1 index. Arms never played are
+// picked first, in random order.
+func (b BanditStrategy) Select(stats map[string]StrategyStats) string {
+	total := 0
+	for _, arm := range b.Arms {
+		total += stats[arm].Plays
+	}
+
+	best := ""
+	bestIndex := 0.0
+	for _, i := range rand.Perm(len(b.Arms)) {
+		arm := b.Arms[i]
+		s := stats[arm]
+		if s.Plays == 0 {
+			return arm
+		}
+		index := s.Reward() + math.Sqrt(2*math.Log(float64(total))/float64(s.Plays))
+		if best == "" || index > bestIndex {
+			best = arm
+			bestIndex = index
+		}
+	}
+	return best
+}
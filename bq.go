@@ -3,18 +3,21 @@ package main
 
 import (
 	"fmt"
+	"golang.org/x/net/context"
 	bigquery "google.golang.org/api/bigquery/v2"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
 	"net/http"
 	"strings"
 )
 
+// Dataset of the plays and games tables in BigQuery
+const BigQueryDataset = "demo"
+
 // Create BigQuery tables for plays and games in current project (admin only)
 func CreateBigQueryTableHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	log.Debugf(c, ">>> Create BigQuery Table Handler")
+	logger.Debugf(c, ">>> Create BigQuery Table Handler")
 
 	// Check if user is logged in, otherwise exit (as redirect was requested)
 	if RedirectIfNotLoggedIn(w, r) {
@@ -22,24 +25,26 @@ func CreateBigQueryTableHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if user.IsAdmin(c) == false {
-		log.Errorf(c, "Error, user %v is not authorized to create table in BigQuery", user.Current(c).Email)
+		logger.Errorf(c, "Error, user %v is not authorized to create table in BigQuery", user.Current(c).Email)
 		http.Error(w, "Unauthorized Access", http.StatusUnauthorized)
 		return
 	}
 
 	projectId := strings.Replace(appengine.DefaultVersionHostname(c), ".appspot.com", "", 1)
-	log.Debugf(c, "Project: %v", projectId)
+	logger.Debugf(c, "Project: %v", projectId)
 
 	newTable := &bigquery.Table{
 		TableReference: &bigquery.TableReference{
 			ProjectId: projectId,
-			DatasetId: "demo",
+			DatasetId: BigQueryDataset,
 			TableId:   "plays",
 		},
 		FriendlyName: "Rock Paper Scissors Data",
 		Schema: &bigquery.TableSchema{
 			Fields: []*bigquery.TableFieldSchema{
 				{Name: "CookieId", Type: "STRING", Description: "User Cookie Id"},
+				{Name: "RuleSet", Type: "STRING", Description: "Rule Set (classic if empty)"},
+				{Name: "Opponent", Type: "STRING", Description: "Opponent Cookie Id (server if empty)"},
 				{Name: "Time", Type: "TIMESTAMP", Description: "Time"},
 				{Name: "User", Type: "STRING", Description: "Current User Play"},
 				{Name: "Server", Type: "STRING", Description: "Current Server Play"},
@@ -62,7 +67,7 @@ func CreateBigQueryTableHandler(w http.ResponseWriter, r *http.Request) {
 
 	err := CreateTableInBigQuery(c, newTable)
 	if err != nil {
-		log.Errorf(c, "Error requesting table creation in BigQuery: %v", err)
+		logger.Errorf(c, "Error requesting table creation in BigQuery: %v", err)
 		http.Error(w, "Internal Error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -70,13 +75,15 @@ func CreateBigQueryTableHandler(w http.ResponseWriter, r *http.Request) {
 	newTable2 := &bigquery.Table{
 		TableReference: &bigquery.TableReference{
 			ProjectId: projectId,
-			DatasetId: "demo",
+			DatasetId: BigQueryDataset,
 			TableId:   "games",
 		},
 		FriendlyName: "Rock Paper Scissors Game Results",
 		Schema: &bigquery.TableSchema{
 			Fields: []*bigquery.TableFieldSchema{
 				{Name: "CookieId", Type: "STRING", Description: "User Cookie Id"},
+				{Name: "RuleSet", Type: "STRING", Description: "Rule Set (classic if empty)"},
+				{Name: "Opponent", Type: "STRING", Description: "Opponent Cookie Id (server if empty)"},
 				{Name: "Time", Type: "TIMESTAMP", Description: "Time"},
 				{Name: "User", Type: "STRING", Description: "User Plays"},
 				{Name: "Server", Type: "STRING", Description: "Server Plays"},
@@ -98,10 +105,70 @@ func CreateBigQueryTableHandler(w http.ResponseWriter, r *http.Request) {
 
 	err = CreateTableInBigQuery(c, newTable2)
 	if err != nil {
-		log.Errorf(c, "Error requesting table creation in BigQuery: %v", err)
+		logger.Errorf(c, "Error requesting table creation in BigQuery: %v", err)
 		http.Error(w, "Internal Error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	fmt.Fprint(w, "<h1>Table Created</h1>")
 }
+
+// Sink streaming the events to the plays and games tables of a dataset
+// in BigQuery, in the project of the application unless ProjectId is
+// set
+type BigQuerySink struct {
+	ProjectId string
+	Dataset   string
+}
+
+func (s BigQuerySink) SendPlay(c context.Context, e PlayEvent) error {
+	return s.SendBatch(c, EventBatch{Plays: []PlayEvent{e}})
+}
+
+func (s BigQuerySink) SendGame(c context.Context, e GameEvent) error {
+	return s.SendBatch(c, EventBatch{Games: []GameEvent{e}})
+}
+
+// Stream the plays and the games of a batch in their tables, with their
+// insert ids so BigQuery drops the rows of a batch sent again
+func (s BigQuerySink) SendBatch(c context.Context, b EventBatch) error {
+
+	// Get project Id where to store data in BigQuery
+	projectId := s.ProjectId
+	if projectId == "" {
+		projectId = strings.Replace(appengine.DefaultVersionHostname(c), ".appspot.com", "", 1)
+	}
+	logger.Debugf(c, "Project: %v", projectId)
+
+	var plays, games []*bigquery.TableDataInsertAllRequestRows
+	for _, e := range b.Plays {
+		plays = append(plays, &bigquery.TableDataInsertAllRequestRows{InsertId: e.InsertId(), Json: e.Row()})
+	}
+	for _, e := range b.Games {
+		games = append(games, &bigquery.TableDataInsertAllRequestRows{InsertId: e.InsertId(), Json: e.Row()})
+	}
+	if err := s.insert(c, projectId, "plays", plays); err != nil {
+		return err
+	}
+	return s.insert(c, projectId, "games", games)
+
+}
+
+// Stream rows in a table. Tables created by older versions get their
+// missing columns from /init, rows with unknown columns being refused
+// rather than silently truncated.
+func (s BigQuerySink) insert(c context.Context, projectId, tableId string, rows []*bigquery.TableDataInsertAllRequestRows) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	bq_req := &bigquery.TableDataInsertAllRequest{
+		Kind: "bigquery#tableDataInsertAllRequest",
+		Rows: rows,
+	}
+	err := StreamDataInBigquery(c, projectId, s.Dataset, tableId, bq_req)
+	if err != nil {
+		logger.Errorf(c, "Error while streaming %v rows to BigQuery table %v: %v", len(rows), tableId, err)
+		logger.Debugf(c, "Request: %v", ToJSON(bq_req))
+	}
+	return err
+}
@@ -0,0 +1,311 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"math/rand"
+	"time"
+)
+
+// Number of shards of a play counter, so that plays in the same context
+// can be recorded at the same time, and age after which the total of a
+// counter is stored again from its shards
+const (
+	PlayCounterShards  = 20
+	PlayCounterRefresh = 10 * time.Second
+)
+
+// Structure to store in Datastore the counts of the next user play/move
+// after a context of the last 2 user and server plays of a rule set, of
+// all players or of one player (CookieId). Counts are by move, in the
+// order of the moves of the rule set. Plays are counted in shards (kind
+// PlayCounterShard), summed up when read by the strategies, and from
+// time to time in a total (kind PlayCounter). The plays stored before
+// the first one counted (Since of the shards) are counted once from the
+// GamePlay entities, and kept in the Legacy counts of the total.
+type PlayCounter struct {
+	RuleSet     string    `json:"rule_set"`
+	CookieId    string    `json:"cookie_id,omitempty"`
+	UserPlays   string    `json:"user_plays"`
+	ServerPlays string    `json:"server_plays"`
+	Counts      []int     `json:"counts" datastore:",noindex"`
+	Total       int       `json:"total" datastore:",noindex"`
+	Since       time.Time `json:"since,omitempty" datastore:",noindex"`
+	Legacy      []int     `json:"legacy,omitempty" datastore:",noindex"`
+	LegacyTotal int       `json:"legacy_total,omitempty" datastore:",noindex"`
+	Backfilled  bool      `json:"backfilled,omitempty" datastore:",noindex"`
+	UpdatedTime time.Time `json:"updated_time" datastore:",noindex"`
+}
+
+// Return the counter of the context of a play: the last 2 user and
+// server plays, of all players if cookieId is ""
+func NewPlayCounter(rs *RuleSet, userPlays, serverPlays, cookieId string) PlayCounter {
+	return PlayCounter{
+		RuleSet:     rs.Name,
+		CookieId:    cookieId,
+		UserPlays:   LastNCharacters(userPlays, 2),
+		ServerPlays: LastNCharacters(serverPlays, 2),
+		Counts:      make([]int, len(rs.Codes)),
+	}
+}
+
+// Return the name of the counter, e.g. "classic/:rp:sr" for all players
+func (p PlayCounter) Name() string {
+	return fmt.Sprintf("%v/%v:%v:%v", p.RuleSet, p.CookieId, p.UserPlays, p.ServerPlays)
+}
+
+// Return the Datastore key of the total of the counter
+func (p PlayCounter) Key(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "PlayCounter", p.Name(), 0, nil)
+}
+
+// Return the Datastore key of a shard of the counter
+func (p PlayCounter) ShardKey(c context.Context, shard int) *datastore.Key {
+	return datastore.NewKey(c, "PlayCounterShard", fmt.Sprintf("%v#%v", p.Name(), shard), 0, nil)
+}
+
+// Return the frequency histogram of the counter, by move code
+func (p PlayCounter) Frequencies(rs *RuleSet) map[string]int {
+	freq := make(map[string]int)
+	for i, n := range p.Counts {
+		if i < len(rs.Codes) && n > 0 {
+			freq[rs.Codes[i]] = n
+		}
+	}
+	return freq
+}
+
+// Count a play in a random shard of its counter, in a transaction which
+// may count it in other counters too
+func (p PlayCounter) add(tc context.Context, rs *RuleSet, gamePlay GamePlay) error {
+	i := rs.Index(gamePlay.CurrentUserPlay)
+	if i < 0 {
+		return ErrorUnknownPlay
+	}
+	key := p.ShardKey(tc, rand.Intn(PlayCounterShards))
+	shard := p
+	shard.Counts = nil
+	err := datastore.Get(tc, key, &shard)
+	if err == datastore.ErrNoSuchEntity {
+		shard.Since = gamePlay.CreatedTime
+	} else if err != nil {
+		return err
+	}
+	for len(shard.Counts) < len(rs.Codes) {
+		shard.Counts = append(shard.Counts, 0)
+	}
+	shard.Counts[i]++
+	shard.Total++
+	shard.UpdatedTime = time.Now()
+	_, err = datastore.Put(tc, key, &shard)
+	return err
+}
+
+// Store again the total of the counter if it is older than
+// PlayCounterRefresh, or if the plays stored before the shards were not
+// counted yet
+func (p PlayCounter) refreshIfStale(c context.Context, rs *RuleSet) error {
+	total := PlayCounter{}
+	err := datastore.Get(c, p.Key(c), &total)
+	if err == nil && total.Backfilled && time.Since(total.UpdatedTime) < PlayCounterRefresh {
+		return nil
+	}
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return p.Refresh(c, rs)
+}
+
+// Return the sum of the shards of the counter, with the time of the
+// first play they count, and whether a shard counted plays before it
+// kept that time, which hides when counting started
+func (p PlayCounter) sumShards(c context.Context, rs *RuleSet) (PlayCounter, bool, error) {
+	keys := make([]*datastore.Key, PlayCounterShards)
+	for i := range keys {
+		keys[i] = p.ShardKey(c, i)
+	}
+	shards := make([]PlayCounter, PlayCounterShards)
+	err := datastore.GetMulti(c, keys, shards)
+	merr, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return p, false, err
+	}
+
+	countedBefore := false
+	sum := p
+	sum.Counts = make([]int, len(rs.Codes))
+	sum.Total = 0
+	for i, shard := range shards {
+		if ok && merr[i] == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if ok && merr[i] != nil {
+			return p, false, merr[i]
+		}
+		for j, n := range shard.Counts {
+			if j < len(sum.Counts) {
+				sum.Counts[j] += n
+			}
+		}
+		sum.Total += shard.Total
+		if shard.Since.IsZero() {
+			countedBefore = true
+		} else if sum.Since.IsZero() || shard.Since.Before(sum.Since) {
+			sum.Since = shard.Since
+		}
+	}
+	return sum, countedBefore, nil
+}
+
+// Add the counts of the plays stored before the shards to their sum
+func (p *PlayCounter) addLegacy(legacy []int, legacyTotal int) {
+	for j, n := range legacy {
+		if j < len(p.Counts) {
+			p.Counts[j] += n
+		}
+	}
+	p.Total += legacyTotal
+	p.Legacy, p.LegacyTotal = legacy, legacyTotal
+}
+
+// Compute the total of the counter from its shards, and from the plays
+// stored before them the first time
+func (p PlayCounter) Refresh(c context.Context, rs *RuleSet) error {
+	total := PlayCounter{}
+	if err := datastore.Get(c, p.Key(c), &total); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	legacy, legacyTotal := total.Legacy, total.LegacyTotal
+	backfilled := total.Backfilled
+
+	total, countedBefore, err := p.sumShards(c, rs)
+	if err != nil {
+		return err
+	}
+	if !backfilled {
+		if legacy, legacyTotal, err = p.backfill(c, rs, total, countedBefore); err != nil {
+			return err
+		}
+		backfilled = true
+	}
+	total.addLegacy(legacy, legacyTotal)
+	total.Backfilled = backfilled
+	total.UpdatedTime = time.Now()
+	_, err = datastore.Put(c, p.Key(c), &total)
+	return err
+}
+
+// Return the counts by move of the plays of the context of the counter
+// stored before the first one counted in its shards, and their number.
+// If the shards don't tell when counting started, every play since then
+// being counted, these are the plays stored minus the ones counted.
+func (p PlayCounter) backfill(c context.Context, rs *RuleSet, shards PlayCounter, countedBefore bool) ([]int, int, error) {
+	since := shards.Since
+	if since.IsZero() || countedBefore {
+		since = time.Now()
+	}
+	q := datastore.NewQuery("GamePlay").
+		Filter("Last2UserPlays =", p.UserPlays).
+		Filter("Last2ServerPlays =", p.ServerPlays)
+	if p.CookieId != "" {
+		q = q.Filter("CookieId =", p.CookieId)
+	}
+	if rs != Classic {
+		q = q.Filter("RuleSet =", rs.Name)
+	}
+	counts := make([]int, len(rs.Codes))
+	for t := q.Run(c); ; {
+		var gp GamePlay
+		_, err := t.Next(&gp)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if !gp.InRuleSet(rs) || !gp.CreatedTime.Before(since) {
+			continue
+		}
+		if i := rs.Index(gp.CurrentUserPlay); i >= 0 {
+			counts[i]++
+		}
+	}
+
+	n := 0
+	for i := range counts {
+		if countedBefore && i < len(shards.Counts) {
+			counts[i] -= shards.Counts[i]
+			if counts[i] < 0 {
+				counts[i] = 0
+			}
+		}
+		n += counts[i]
+	}
+	return counts, n, nil
+}
+
+// Count a recorded play in the counters of its context, of all players
+// and of its player, in a single transaction, then store again their
+// totals if they are stale
+func RecordPlayCounters(c context.Context, rs *RuleSet, gamePlay GamePlay) error {
+	cookieIds := []string{""}
+	if gamePlay.CookieId != "" {
+		cookieIds = append(cookieIds, gamePlay.CookieId)
+	}
+	counters := make([]PlayCounter, len(cookieIds))
+	for i, cookieId := range cookieIds {
+		counters[i] = NewPlayCounter(rs, gamePlay.LastUserPlays, gamePlay.LastServerPlays, cookieId)
+	}
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		for _, counter := range counters {
+			if err := counter.add(tc, rs, gamePlay); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return err
+	}
+	for _, counter := range counters {
+		if err := counter.refreshIfStale(c, rs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function of the tasks counting a recorded play, out of the request
+var countPlayLater = delay.Func("count-play", func(c context.Context, ruleSetName string, gamePlay GamePlay) error {
+	rs, err := GetRuleSet(ruleSetName)
+	if err != nil {
+		return err
+	}
+	return RecordPlayCounters(c, rs, gamePlay)
+})
+
+// Return the counter of the context of the next play, summing its shards
+// so the plays counted since its total was stored are counted too, and
+// false if the plays stored before the shards were not counted yet
+func GetPlayCounter(c context.Context, rs *RuleSet, userPlays, serverPlays, cookieId string) (PlayCounter, bool, error) {
+	counter := NewPlayCounter(rs, userPlays, serverPlays, cookieId)
+	stored := PlayCounter{}
+	err := datastore.Get(c, counter.Key(c), &stored)
+	if err == datastore.ErrNoSuchEntity || (err == nil && !stored.Backfilled) {
+		return counter, false, nil
+	}
+	if err != nil {
+		return counter, false, err
+	}
+	sum, _, err := counter.sumShards(c, rs)
+	if err != nil {
+		return counter, false, err
+	}
+	sum.addLegacy(stored.Legacy, stored.LegacyTotal)
+	sum.Backfilled, sum.UpdatedTime = true, stored.UpdatedTime
+	return sum, true, nil
+}
@@ -0,0 +1,89 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"golang.org/x/net/context"
+	"math/rand"
+	"net/http"
+)
+
+// Name of the difficulty used when none is requested
+const DefaultDifficultyName = "normal"
+
+// Difficulty level selectable by the player, played with a strategy.
+// Guarded difficulties fall back to random play when exploited.
+type Difficulty struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Strategy string `json:"strategy"`
+	Guarded  bool   `json:"guarded"`
+}
+
+// Difficulty levels, from the easiest to the hardest
+var difficulties = []Difficulty{
+	{Name: "easy", Label: "Easy", Strategy: "easy", Guarded: false},
+	{Name: "normal", Label: "Normal", Strategy: "frequency", Guarded: true},
+	{Name: "hard", Label: "Hard", Strategy: "iocaine", Guarded: true},
+	{Name: "unbeatable", Label: "Unbeatable-ish", Strategy: "bandit", Guarded: true},
+}
+
+// Return the difficulty named name, and false if there is none
+func GetDifficulty(name string) (Difficulty, bool) {
+	for _, d := range difficulties {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return Difficulty{}, false
+}
+
+// Return the strategy to use for a request: the "strategy" parameter
+// if any, then the strategy of the difficulty level, then the
+// configured one. Strategies are guarded unless the level says
+// otherwise.
+func RequestStrategy(r *http.Request, level string) Strategy {
+	if r.FormValue("strategy") == "" {
+		if d, ok := GetDifficulty(level); ok {
+			if !d.Guarded {
+				return GetStrategy(d.Strategy)
+			}
+			return Guard(GetStrategy(d.Strategy))
+		}
+	}
+	return Guard(GetStrategy(StrategyName(r)))
+}
+
+// Return the strategy of a game session, chosen when the game started,
+// guarded unless its difficulty level says otherwise
+func SessionStrategy(s *GameSession) Strategy {
+	if d, ok := GetDifficulty(s.Level); ok && d.Strategy == s.Strategy && !d.Guarded {
+		return GetStrategy(s.Strategy)
+	}
+	return Guard(GetStrategy(s.Strategy))
+}
+
+// Strategy for beginners: half of the time it plays at random, the
+// other half it plays the move beating its last play (e.g. rock, paper,
+// scissor), a pattern players can learn to beat
+type EasyStrategy struct{}
+
+func init() {
+	RegisterStrategy(EasyStrategy{})
+}
+
+func (EasyStrategy) Name() string {
+	return "easy"
+}
+
+func (EasyStrategy) Play(c context.Context, round Round) (Decision, error) {
+	rs := round.RuleSet
+	next := rs.Counter(LastNCharacters(round.ServerPlays, 1))
+	if next == "" || rand.Intn(2) == 0 {
+		return rs.RandomDecision(), nil
+	}
+	return Decision{
+		Play:         next,
+		Confidence:   1 / float64(len(rs.Moves)),
+		Distribution: rs.UniformDistribution(),
+	}, nil
+}
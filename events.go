@@ -0,0 +1,239 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mssola/user_agent"
+	"golang.org/x/net/context"
+	bigquery "google.golang.org/api/bigquery/v2"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Play of a round sent to the analytics, from the point of view of a
+// player: the "server" is the bot, or the other player if Opponent is
+// set. Fields are named like the columns of the BigQuery plays table.
+type PlayEvent struct {
+	CookieId   string
+	RuleSet    string
+	Opponent   string
+	Time       time.Time
+	User       string
+	Server     string
+	LastUser   string
+	LastServer string
+	Client     ClientInfo
+}
+
+// Finished game sent to the analytics, from the point of view of a
+// player. Fields are named like the columns of the BigQuery games table.
+type GameEvent struct {
+	CookieId string
+	RuleSet  string
+	Opponent string
+	Time     time.Time
+	User     string
+	Server   string
+	Winner   string
+	Client   ClientInfo
+}
+
+// Return the event of a play, by the client of its player
+func NewPlayEvent(gamePlay GamePlay, client ClientInfo) PlayEvent {
+	return PlayEvent{
+		CookieId:   gamePlay.CookieId,
+		RuleSet:    gamePlay.RuleSet,
+		Opponent:   gamePlay.Opponent,
+		Time:       gamePlay.CreatedTime,
+		User:       gamePlay.CurrentUserPlay,
+		Server:     gamePlay.CurrentServerPlay,
+		LastUser:   gamePlay.LastUserPlays,
+		LastServer: gamePlay.LastServerPlays,
+		Client:     client,
+	}
+}
+
+// Return the event of a finished game, by the client of its player
+func NewGameEvent(result GameResult, client ClientInfo) GameEvent {
+	return GameEvent{
+		CookieId: result.CookieId,
+		RuleSet:  result.RuleSet,
+		Opponent: result.Opponent,
+		Time:     result.Time,
+		User:     result.UserPlays,
+		Server:   result.ServerPlays,
+		Winner:   result.Winner,
+		Client:   client,
+	}
+}
+
+// Return the id of the play, for BigQuery to drop the rows sent again
+func (e PlayEvent) InsertId() string {
+	return fmt.Sprintf("%v-%v", e.CookieId, e.Time.UnixNano())
+}
+
+// Return the id of the game, for BigQuery to drop the rows sent again
+func (e GameEvent) InsertId() string {
+	return fmt.Sprintf("%v-%v", e.CookieId, e.Time.UnixNano())
+}
+
+// Return the row of the play in the BigQuery plays table
+func (e PlayEvent) Row() map[string]bigquery.JsonValue {
+	row := e.Client.Row()
+	row["CookieId"] = e.CookieId
+	row["RuleSet"] = e.RuleSet
+	row["Opponent"] = e.Opponent
+	row["Time"] = e.Time
+	row["User"] = e.User
+	row["Server"] = e.Server
+	row["LastUser"] = e.LastUser
+	row["LastServer"] = e.LastServer
+	return row
+}
+
+// Return the row of the game in the BigQuery games table
+func (e GameEvent) Row() map[string]bigquery.JsonValue {
+	row := e.Client.Row()
+	row["CookieId"] = e.CookieId
+	row["RuleSet"] = e.RuleSet
+	row["Opponent"] = e.Opponent
+	row["Time"] = e.Time
+	row["User"] = e.User
+	row["Server"] = e.Server
+	row["Winner"] = e.Winner
+	return row
+}
+
+// Return the columns of the client in the BigQuery tables, with some
+// basic information extracted from its user agent
+func (client ClientInfo) Row() map[string]bigquery.JsonValue {
+	ua := user_agent.New(client.UserAgent)
+	engineName, engineVersion := ua.Engine()
+	browserName, browserVersion := ua.Browser()
+	return map[string]bigquery.JsonValue{
+		"Country":        client.Country,
+		"Region":         client.Region,
+		"City":           client.City,
+		"IsMobile":       ua.Mobile(),
+		"MozillaVersion": ua.Mozilla(),
+		"Platform":       ua.Platform(),
+		"OS":             ua.OS(),
+		"EngineName":     engineName,
+		"EngineVersion":  engineVersion,
+		"BrowserName":    browserName,
+		"BrowserVersion": browserVersion,
+	}
+}
+
+// Plays and finished games sent at once to the analytics
+type EventBatch struct {
+	Plays []PlayEvent
+	Games []GameEvent
+}
+
+// Return the number of events of the batch
+func (b EventBatch) Len() int {
+	return len(b.Plays) + len(b.Games)
+}
+
+// Destination of the plays and finished games for analytics
+type EventSink interface {
+	// Send the play of a round
+	SendPlay(c context.Context, e PlayEvent) error
+	// Send a finished game
+	SendGame(c context.Context, e GameEvent) error
+	// Send a batch of plays and games. Sending a batch again after an
+	// error must not duplicate the events already sent, as far as the
+	// sink can tell.
+	SendBatch(c context.Context, b EventBatch) error
+}
+
+// Sink of the events of the application, sending them to BigQuery from
+// tasks out of the requests
+var eventSink EventSink = TaskQueueSink{Queue: AnalyticsQueue}
+
+// Sink dropping the events, when there are no analytics
+type NoEventSink struct{}
+
+func (NoEventSink) SendPlay(c context.Context, e PlayEvent) error {
+	return nil
+}
+
+func (NoEventSink) SendGame(c context.Context, e GameEvent) error {
+	return nil
+}
+
+func (NoEventSink) SendBatch(c context.Context, b EventBatch) error {
+	return nil
+}
+
+// Sink writing the events as newline delimited JSON, each line being the
+// row of the event in its BigQuery table with its Type, "play" or
+// "game". The plays of the file can be replayed by the backtest command.
+type JSONLSink struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// Return a sink writing the events to w
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	return &JSONLSink{w: w}
+}
+
+// Return a sink appending the events to a file, created if needed
+func OpenJSONLSink(path string) (*JSONLSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLSink{w: f, closer: f}, nil
+}
+
+func (s *JSONLSink) SendPlay(c context.Context, e PlayEvent) error {
+	return s.SendBatch(c, EventBatch{Plays: []PlayEvent{e}})
+}
+
+func (s *JSONLSink) SendGame(c context.Context, e GameEvent) error {
+	return s.SendBatch(c, EventBatch{Games: []GameEvent{e}})
+}
+
+// Write the rows of the events of a batch in a single write, so a failed
+// batch is not partly written
+func (s *JSONLSink) SendBatch(c context.Context, b EventBatch) error {
+	var lines []byte
+	write := func(eventType string, row map[string]bigquery.JsonValue) error {
+		row["Type"] = eventType
+		line, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+		return nil
+	}
+	for _, e := range b.Plays {
+		if err := write("play", e.Row()); err != nil {
+			return err
+		}
+	}
+	for _, e := range b.Games {
+		if err := write("game", e.Row()); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.w.Write(lines)
+	return err
+}
+
+// Close the file of the sink, if opened by OpenJSONLSink
+func (s *JSONLSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
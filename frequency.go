@@ -0,0 +1,69 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"golang.org/x/net/context"
+)
+
+// Strategy countering the most frequent user play/move seen in
+// previous games with the same last 2 user and server plays
+type FrequencyStrategy struct{}
+
+func init() {
+	RegisterStrategy(FrequencyStrategy{})
+}
+
+func (FrequencyStrategy) Name() string {
+	return "frequency"
+}
+
+func (FrequencyStrategy) Play(c context.Context, round Round) (Decision, error) {
+
+	// Create frequency histogram of user's move/play in previous
+	// plays with the same conditions
+	rs := round.RuleSet
+	freq, n, err := GetContextFrequencies(c, rs, round.UserPlays, round.ServerPlays, "")
+	if err != nil {
+		return Decision{}, err
+	}
+
+	// If no plays/moves in datastore, return default (random) value
+	if n == 0 {
+		logger.Infof(c, "No statistics, providing default value")
+		return rs.RandomDecision(), nil
+	}
+
+	// Find the most common play/move, in order of moves so the same
+	// plays always give the same answer
+	//TODO: improve randomness in case of equality between 2 or 3 plays
+	mostFreqPlay := ""
+	for _, p := range rs.Codes {
+		if freq[p] > 0 && (mostFreqPlay == "" || freq[p] > freq[mostFreqPlay]) {
+			mostFreqPlay = p
+		}
+	}
+
+	// Provide opposite play (i.e. paper for rock, rock for scissors,
+	// or scissors for paper)
+	answer := rs.Counter(mostFreqPlay)
+	if answer == "" {
+		logger.Errorf(c, "Unkown most frequent answer %v, showing default value", mostFreqPlay)
+		return rs.RandomDecision(), nil
+	}
+	logger.Debugf(c, "Most frequent sign is %v, showing %v", mostFreqPlay, answer)
+
+	return Decision{
+		Play:         answer,
+		Confidence:   float64(freq[mostFreqPlay]) / float64(n),
+		Distribution: rs.NewDistribution(freq),
+		Samples:      n,
+	}, nil
+}
+
+// Return the frequency histogram of the next user play/move in the
+// previous plays of the rule set with the same last 2 user and server
+// plays, and the number of plays found, from the play store. Only plays
+// of cookieId are used if not "".
+func GetContextFrequencies(c context.Context, rs *RuleSet, userPlays, serverPlays, cookieId string) (map[string]int, int, error) {
+	return playStore.ContextFrequencies(c, rs, userPlays, serverPlays, cookieId)
+}
@@ -3,24 +3,14 @@ package main
 
 import (
 	"fmt"
-	"github.com/mssola/user_agent"
-	bigquery "google.golang.org/api/bigquery/v2"
+	"golang.org/x/net/context"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 	"math/rand"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 )
 
-// Three possible answers from the game
-var answers = []string{
-	"rock",
-	"paper",
-	"scissor",
-}
-
 // Structure to store a game play in Datastore
 type GamePlay struct {
 	CurrentUserPlay   string    `json:"current_user_play"`
@@ -33,261 +23,337 @@ type GamePlay struct {
 	Last2ServerPlays  string    `json:"last_2_server_play"`
 	CreatedTime       time.Time `json:"created_time,omitempty"`
 	CookieId          string    `json:"cookie_id,omitempty"`
+	Strategy          string    `json:"strategy,omitempty"`
+	Commitment        string    `json:"commitment,omitempty" datastore:",noindex"`
+	Nonce             string    `json:"nonce,omitempty" datastore:",noindex"`
+	RuleSet           string    `json:"rule_set,omitempty"`
+	Opponent          string    `json:"opponent,omitempty"`
 }
 
-// Structure used to record a game at its end
-type Request struct {
-	Winner string `json:"winner,omitempty"`
-	User   string `json:"user,omitempty"`
-	Server string `json:"server,omitempty"`
+// Information on the client of a player, sent to the analytics with its
+// plays and games
+type ClientInfo struct {
+	UserAgent string
+	Country   string
+	Region    string
+	City      string
 }
 
-// Compress a set of plays by their first letter.
-// For example "rock paper rock" will return "rpr"
-func Compress(text string) string {
-	result := ""
-	for _, w := range strings.Split(text, " ") {
-		for _, a := range answers {
-			if w == a {
-				result += string(a[0])
-				break
-			}
-		}
+// Return the information on the client of a request
+func NewClientInfo(r *http.Request) ClientInfo {
+	return ClientInfo{
+		UserAgent: r.Header.Get("User-Agent"),
+		Country:   r.Header.Get("X-AppEngine-Country"),
+		Region:    r.Header.Get("X-AppEngine-Region"),
+		City:      r.Header.Get("X-AppEngine-City"),
 	}
-	return result
 }
 
-// Handler to provide the server next play/move
-// Return rock, paper or scissors in HTTP response
-func PlayHandler(w http.ResponseWriter, r *http.Request) {
+// Result of a finished game from the point of view of a player. The
+// "server" is the bot, or the other player if Opponent is set.
+type GameResult struct {
+	CookieId    string
+	Opponent    string
+	RuleSet     string
+	UserPlays   string
+	ServerPlays string
+	// Strategy which decided the most server plays, e.g. an arm of the
+	// bandit, none against another player
+	Strategy string
+	Winner   string
+	Time     time.Time
+}
 
-	c := appengine.NewContext(r)
+// Return the play of the last round of a game, with the plays before it
+func NewGamePlay(userPlays, serverPlays string) GamePlay {
+	n := len(userPlays) - 1
+	return GamePlay{
+		CurrentUserPlay:   userPlays[n:],
+		CurrentServerPlay: serverPlays[n:],
+		LastUserPlays:     userPlays[:n],
+		LastServerPlays:   serverPlays[:n],
+		Last3UserPlays:    LastNCharacters(userPlays[:n], 3),
+		Last3ServerPlays:  LastNCharacters(serverPlays[:n], 3),
+		Last2UserPlays:    LastNCharacters(userPlays[:n], 2),
+		Last2ServerPlays:  LastNCharacters(serverPlays[:n], 2),
+		CreatedTime:       time.Now(),
+	}
+}
 
-	log.Infof(c, ">>>> Play Handler")
+// Return the decision of a strategy for a round, or a random play
+// if the strategy fails
+func Decide(c context.Context, strategy Strategy, round Round) Decision {
+	logger.Debugf(c, "Strategy: %v", strategy.Name())
 
-	// Shuffle random generator with Unix time
-	rand.Seed(time.Now().UnixNano())
+	// If error, return default (random) value after emiting error message in log
+	decision, err := strategy.Play(c, round)
+	if err != nil {
+		logger.Errorf(c, "Error, strategy %v failed: %v", strategy.Name(), err)
+		logger.Infof(c, "Providing default value")
+		decision = round.RuleSet.RandomDecision()
+	}
+	if decision.Strategy == "" {
+		decision.Strategy = strategy.Name()
+	}
+	return decision
+}
 
-	// Pick randomly one of the play/move.
-	// To be used as default value for this request
-	defaultValue := answers[rand.Intn(len(answers))]
+// Return the error status code for errors of the game session functions
+func GameErrorStatus(err error) int {
+	switch err {
+	case ErrorGameNotFound:
+		return http.StatusNotFound
+	case ErrorNotYourGame:
+		return http.StatusForbidden
+	case ErrorInvalidGameId, ErrorUnknownPlay, ErrorGameFinished, ErrorNoServerPlay,
+		ErrorUnknownRules, ErrorInvalidRules, ErrorUnknownRuleSet:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
 
-	// Get at most 100 previous plays/moves with same conditions
-	// in the last 2 round for users and server
-	var gamePlays []GamePlay
-	q := datastore.NewQuery("GamePlay").
-		Filter("Last2UserPlays =", LastNCharacters(r.FormValue("pu"), 2)).
-		Filter("Last2ServerPlays =", LastNCharacters(r.FormValue("pu"), 2)).
-		Limit(100)
-	_, err := q.GetAll(c, &gamePlays)
+// Start a new game for the player, following the requested game rules
+// and rule set
+// Return the game session in JSON in HTTP response
+func StartGameHandler(w http.ResponseWriter, r *http.Request) {
 
-	// If error, return default (random) value after emiting error message in log
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Start Game Handler")
+
+	rules, err := RequestGameRules(r)
 	if err != nil {
-		log.Errorf(c, "Error, searching for previous plays: %v", err)
-		log.Infof(c, "Providing default value")
-		fmt.Fprint(w, defaultValue)
+		logger.Errorf(c, "Error, invalid game rules: %v", err)
+		http.Error(w, "Error: "+err.Error(), GameErrorStatus(err))
 		return
 	}
 
-	// If no plays/moves in datastore, return default (random) value
-	if len(gamePlays) == 0 {
-		log.Infof(c, "No statistics, providing default value")
-		fmt.Fprint(w, defaultValue)
+	ruleSet, err := RequestRuleSet(r)
+	if err != nil {
+		logger.Errorf(c, "Error, invalid rule set: %v", err)
+		http.Error(w, "Error: "+err.Error(), GameErrorStatus(err))
 		return
 	}
 
-	// Create frequency histogram of user's move/play
-	freq := make(map[string]int)
-	for _, gp := range gamePlays {
-		freq[gp.CurrentUserPlay]++
+	level := r.FormValue("level")
+	strategy := RequestStrategy(r, level).Name()
+	session, err := NewGameSession(c, RequestCookieId(r), level, strategy, rules, ruleSet)
+	if err != nil {
+		logger.Errorf(c, "Error while creating game: %v", err)
+		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// Find the most common play/move
-	//TODO: improve randomness in case of equality between 2 or 3 plays
-	mostFreqPlay := ""
-	for p, _ := range freq {
-		if mostFreqPlay == "" {
-			mostFreqPlay = p
-		} else {
-			if freq[p] > freq[mostFreqPlay] {
-				mostFreqPlay = p
-			}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(session))
+
+}
+
+// Handler to provide the server next play/move
+// Return rock, paper or scissors in HTTP response, or the decision of
+// the strategy with its reasoning in JSON if format=json.
+// Within a game (g parameter) the play is decided once per round from
+// the plays recorded by the server and only its commitment is returned
+// (in JSON as {"commitment": ...} if format=json), the play is revealed
+// by /record once the user played.
+func PlayHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Play Handler")
+
+	// Shuffle random generator with Unix time
+	rand.Seed(time.Now().UnixNano())
+
+	// Commit to the play of the next round of the game
+	if r.FormValue("g") != "" {
+		id, _ := strconv.ParseInt(r.FormValue("g"), 10, 64)
+		commitment, err := NextSessionPlay(c, id, RequestCookieId(r), func(s *GameSession) Decision {
+			return Decide(c, SessionStrategy(s), s.Round())
+		})
+		if err != nil {
+			logger.Errorf(c, "Error while deciding play of game %v: %v", id, err)
+			http.Error(w, "Error: "+err.Error(), GameErrorStatus(err))
+			return
+		}
+		if r.FormValue("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, ToJSON(map[string]string{"commitment": commitment}))
+			return
 		}
+		fmt.Fprint(w, commitment)
+		return
 	}
 
-	// Uncompress play (r,p,s to rock, paper, scissors), and
-	// provide opposite play (i.e. paper for rock, rock for scissors, or scissors for paper)
-	answer := defaultValue
-	switch {
-	default:
-		log.Errorf(c, "Unkown most frequent answer %v, showing default value", mostFreqPlay)
-	case mostFreqPlay == "r":
-		answer = "paper"
-		log.Debugf(c, "Most frequent sign is Rock, showing Paper")
-	case mostFreqPlay == "p":
-		answer = "scissor"
-		log.Debugf(c, "Most frequent sign is Paper, showing Scissor")
-	case mostFreqPlay == "s":
-		answer = "rock"
-		log.Debugf(c, "Most frequent sign is Scissor, showing Rock")
+	// Get the rule set of the plays
+	ruleSet, err := RequestRuleSet(r)
+	if err != nil {
+		logger.Errorf(c, "Error, invalid rule set: %v", err)
+		http.Error(w, "Error: "+err.Error(), GameErrorStatus(err))
+		return
 	}
 
-	// Return final answer to HTTP response
-	fmt.Fprint(w, answer)
+	// Pick the strategy requested, or the one of the difficulty level
+	decision := Decide(c, RequestStrategy(r, r.FormValue("level")), Round{
+		RuleSet:     ruleSet,
+		CookieId:    r.FormValue("id"),
+		UserPlays:   r.FormValue("pu"),
+		ServerPlays: r.FormValue("ps"),
+	})
+
+	// Return final answer to HTTP response, with the strategy used
+	w.Header().Set("X-Strategy", decision.Strategy)
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, ToJSON(decision))
+		return
+	}
+	fmt.Fprint(w, decision.Play)
 
 }
 
-// Record a play/move once it has been played
+// Record the user play/move of a round of a game (g parameter) against
+// the server play decided by /play, and the game when it is finished
+// Return the game session in JSON in HTTP response, revealing the
+// server play and the nonce of its commitment
 func RecordPlayHandler(w http.ResponseWriter, r *http.Request) {
 
 	c := appengine.NewContext(r)
 
-	log.Infof(c, ">>>> Record Play Handler")
+	logger.Infof(c, ">>>> Record Play Handler")
 
-	// Get User Cookie Id
-	cookieId := r.FormValue("id")
+	// Get game id, emmits error if invalid
+	id, err := strconv.ParseInt(r.FormValue("g"), 10, 64)
+	if err != nil {
+		logger.Errorf(c, "Error, invalid parameter g: %v", err)
+		http.Error(w, "Error, invalid parameter", http.StatusBadRequest)
+		return
+	}
 
-	// Get and compress current user play, emmits error if empty
-	currentUserPlay := Compress(r.FormValue("u"))
+	// Get current user play, emmits error if empty
+	currentUserPlay := r.FormValue("u")
 	if currentUserPlay == "" {
-		log.Errorf(c, "Error, missing parameter u")
-		http.Error(w, "Error, missing parameter", http.StatusInternalServerError)
+		logger.Errorf(c, "Error, missing parameter u")
+		http.Error(w, "Error, missing parameter", http.StatusBadRequest)
 		return
 	}
 
-	// Get and compress current server play, emmits error if empty
-	currentServerPlay := Compress(r.FormValue("s"))
-	if currentServerPlay == "" {
-		log.Errorf(c, "Error, missing parameter s")
-		http.Error(w, "Error, missing parameter", http.StatusInternalServerError)
+	// Play the round against the server play of the game, if it is the
+	// game of the user
+	session, decision, err := PlaySessionRound(c, id, RequestCookieId(r), currentUserPlay)
+	if err != nil {
+		logger.Errorf(c, "Error while playing round of game %v: %v", id, err)
+		http.Error(w, "Error: "+err.Error(), GameErrorStatus(err))
 		return
 	}
 
-	// Record play in Datastore
-	gamePlay := GamePlay{
-		CurrentUserPlay:   currentUserPlay,
-		CurrentServerPlay: currentServerPlay,
-		LastUserPlays:     r.FormValue("pu"),
-		LastServerPlays:   r.FormValue("ps"),
-		Last3UserPlays:    LastNCharacters(r.FormValue("pu"), 3),
-		Last3ServerPlays:  LastNCharacters(r.FormValue("ps"), 3),
-		Last2UserPlays:    LastNCharacters(r.FormValue("pu"), 2),
-		Last2ServerPlays:  LastNCharacters(r.FormValue("ps"), 2),
-		CreatedTime:       time.Now(),
-		CookieId:          cookieId,
-	}
-	if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "GamePlay", nil), &gamePlay); err != nil {
-		log.Errorf(c, "Error while storing play: %v", err)
+	// Record play in the play store
+	gamePlay := NewGamePlay(session.UserPlays, session.ServerPlays)
+	gamePlay.CookieId = session.CookieId
+	gamePlay.Strategy = decision.Strategy
+	gamePlay.Commitment = session.Reveal.Commitment
+	gamePlay.Nonce = session.Reveal.Nonce
+	gamePlay.RuleSet = session.RuleSetName
+	if err := playStore.RecordPlay(c, session.RuleSet(), gamePlay); err != nil {
+		logger.Errorf(c, "Error while storing play: %v", err)
 		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Get project Id where to store data in BigQuery
-	projectId := strings.Replace(appengine.DefaultVersionHostname(c), ".appspot.com", "", 1)
-	log.Debugf(c, "Project: %v", projectId)
-
-	// Extract some basic information of User Agent
-	ua := user_agent.New(r.Header.Get("User-Agent"))
-	engineName, engineversion := ua.Engine()
-	browserName, browserVersion := ua.Browser()
-
-	// Store play in Big Query
-	bq_req := &bigquery.TableDataInsertAllRequest{
-		Kind: "bigquery#tableDataInsertAllRequest",
-		Rows: []*bigquery.TableDataInsertAllRequestRows{
-			{
-				Json: map[string]bigquery.JsonValue{
-					"CookieId":       cookieId,
-					"Time":           time.Now(),
-					"User":           currentUserPlay,
-					"Server":         currentServerPlay,
-					"LastUser":       r.FormValue("pu"),
-					"LastServer":     r.FormValue("ps"),
-					"Country":        r.Header.Get("X-AppEngine-Country"),
-					"Region":         r.Header.Get("X-AppEngine-Region"),
-					"City":           r.Header.Get("X-AppEngine-City"),
-					"IsMobile":       ua.Mobile(),
-					"MozillaVersion": ua.Mozilla(),
-					"Platform":       ua.Platform(),
-					"OS":             ua.OS(),
-					"EngineName":     engineName,
-					"EngineVersion":  engineversion,
-					"BrowserName":    browserName,
-					"BrowserVersion": browserVersion,
-				},
-			},
-		},
+	// Record outcome of the arm of the bandit against this player
+	if err := RecordBanditOutcome(c, session, gamePlay); err != nil {
+		logger.Errorf(c, "Error while recording outcome of strategy %v: %v", gamePlay.Strategy, err)
+	}
+
+	// Send play to the analytics, which never fail the game
+	if err := eventSink.SendPlay(c, NewPlayEvent(gamePlay, NewClientInfo(r))); err != nil {
+		logger.Errorf(c, "Error while sending play to the analytics: %v", err)
+	}
+
+	// Update the rating of the player, the one of the strategy being
+	// updated later by cron, and the leaderboards of the player, once
+	// finished, which need Datastore
+	if session.Finished && session.CookieId != "" && appengine.IsAppEngine() {
+		rating, err := RecordStrategyGame(c, session.CookieId, session.Strategy, Score(session.Winner))
+		if err != nil {
+			logger.Errorf(c, "Error while recording ratings of game %v: %v", id, err)
+			rating, _ = GetRating(c, PlayerRating, session.CookieId)
+		}
+		if err := RecordLeaderboards(c, session.CookieId, NewClientInfo(r).Country, session.Winner, rating.Rating); err != nil {
+			logger.Errorf(c, "Error while recording leaderboards of game %v: %v", id, err)
+		}
+	}
+
+	// Store game in the play store and send it to the analytics once
+	// finished
+	if session.Finished {
+		if err := playStore.RecordGame(c, session.Result()); err != nil {
+			logger.Errorf(c, "Error while storing game %v: %v", id, err)
+		}
+		if err := eventSink.SendGame(c, NewGameEvent(session.Result(), NewClientInfo(r))); err != nil {
+			logger.Errorf(c, "Error while sending game %v to the analytics: %v", id, err)
+		}
 	}
-	err := StreamDataInBigquery(c, projectId, "demo", "plays", bq_req)
+
+	// Return game to HTTP response
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(session))
+
+}
+
+// Provide the current state of a game (g parameter)
+// Return the game session in JSON in HTTP response
+func GameHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Game Handler")
+
+	id, _ := strconv.ParseInt(r.FormValue("g"), 10, 64)
+	session, err := GetGameSession(c, id)
 	if err != nil {
-		log.Errorf(c, "Error while streaming visit to BigQuery: %v", err)
-		log.Debugf(c, "Request: %v", ToJSON(bq_req))
-		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		logger.Errorf(c, "Error while getting game %v: %v", id, err)
+		http.Error(w, "Error: "+err.Error(), GameErrorStatus(err))
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(session))
+
 }
 
-// Record game when it is finished
-func RecordGameHandler(w http.ResponseWriter, r *http.Request) {
+// Provide the last plays of the player (id parameter), at most 100 or
+// the limit parameter, the most recent first
+// Return the plays in JSON in HTTP response
+func HistoryHandler(w http.ResponseWriter, r *http.Request) {
 
 	c := appengine.NewContext(r)
 
-	log.Infof(c, ">>>> Record Game Handler")
+	logger.Infof(c, ">>>> History Handler")
 
-	// Get Cookie Id
 	cookieId := r.FormValue("id")
-
-	// Extract game information from Request's body
-	var gameInfo Request
-	err := UnmarshalRequest(c, r, &gameInfo)
-	if err != nil {
-		log.Errorf(c, "Error while reading body: %v", err)
-		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+	if cookieId == "" {
+		http.Error(w, "Error: "+ErrorMissingCookie.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Get project Id where to store data in BigQuery
-	projectId := strings.Replace(appengine.DefaultVersionHostname(c), ".appspot.com", "", 1)
-	log.Debugf(c, "Project: %v", projectId)
-
-	// Extract some basic information of User Agent
-	ua := user_agent.New(r.Header.Get("User-Agent"))
-	engineName, engineversion := ua.Engine()
-	browserName, browserVersion := ua.Browser()
-
-	// Store game in Big Query
-	bq_req := &bigquery.TableDataInsertAllRequest{
-		Kind: "bigquery#tableDataInsertAllRequest",
-		Rows: []*bigquery.TableDataInsertAllRequestRows{
-			{
-				Json: map[string]bigquery.JsonValue{
-					"CookieId":       cookieId,
-					"User":           gameInfo.User,
-					"Server":         gameInfo.Server,
-					"Winner":         gameInfo.Winner,
-					"Time":           time.Now(),
-					"Country":        r.Header.Get("X-AppEngine-Country"),
-					"Region":         r.Header.Get("X-AppEngine-Region"),
-					"City":           r.Header.Get("X-AppEngine-City"),
-					"IsMobile":       ua.Mobile(),
-					"MozillaVersion": ua.Mozilla(),
-					"Platform":       ua.Platform(),
-					"OS":             ua.OS(),
-					"EngineName":     engineName,
-					"EngineVersion":  engineversion,
-					"BrowserName":    browserName,
-					"BrowserVersion": browserVersion,
-				},
-			},
-		},
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 || limit > HistorySize {
+		limit = HistorySize
 	}
-	err = StreamDataInBigquery(c, projectId, "demo", "games", bq_req)
+
+	gamePlays, err := playStore.PlayerHistory(c, cookieId, limit)
 	if err != nil {
-		log.Errorf(c, "Error while streaming visit to BigQuery: %v", err)
-		log.Debugf(c, "Request: %v", ToJSON(bq_req))
+		logger.Errorf(c, "Error while getting history of player %v: %v", cookieId, err)
 		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Opponents are other players, known by their cookie ids
+	for i := range gamePlays {
+		gamePlays[i].Opponent = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(gamePlays))
+
 }
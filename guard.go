@@ -0,0 +1,69 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"golang.org/x/net/context"
+	"math"
+)
+
+// Name reported for the plays made by the guard itself
+const NashStrategyName = "nash"
+
+// Strategy wrapping another one to protect the server against players
+// exploiting it. When the user leads the game by more than Z standard
+// deviations of random play, after at least MinRounds rounds, the guard
+// plays uniformly at random (the Nash equilibrium, which can't be
+// exploited) for the next Cooldown rounds.
+type GuardedStrategy struct {
+	Strategy
+	Z         float64
+	MinRounds int
+	Cooldown  int
+}
+
+// Wrap a strategy with the default exploitation guard
+func Guard(s Strategy) GuardedStrategy {
+	return GuardedStrategy{Strategy: s, Z: 2, MinRounds: 5, Cooldown: 5}
+}
+
+func (g GuardedStrategy) Play(c context.Context, round Round) (Decision, error) {
+	if g.Exploited(round.RuleSet, round.UserPlays, round.ServerPlays) {
+		logger.Infof(c, "Server exploited by player %v, playing random", round.CookieId)
+		decision := round.RuleSet.RandomDecision()
+		decision.Strategy = NashStrategyName
+		return decision, nil
+	}
+	return g.Strategy.Play(c, round)
+}
+
+// Return true if the user was beating the server beyond what chance
+// would explain at any of the last Cooldown rounds
+func (g GuardedStrategy) Exploited(rs *RuleSet, userPlays, serverPlays string) bool {
+	n := len(userPlays)
+	if len(serverPlays) < n {
+		n = len(serverPlays)
+	}
+
+	// Running score of the user after each round
+	score := make([]int, n+1)
+	for i := 0; i < n; i++ {
+		score[i+1] = score[i]
+		switch {
+		case rs.Beats(userPlays[i:i+1], serverPlays[i:i+1]):
+			score[i+1]++
+		case rs.Beats(serverPlays[i:i+1], userPlays[i:i+1]):
+			score[i+1]--
+		}
+	}
+
+	// Each round of random play with N moves scores +1 or -1 with
+	// probability (N-1)/2N each and 0 otherwise, so a variance of
+	// (N-1)/N per round (2/3 for the classic game)
+	variance := float64(len(rs.Moves)-1) / float64(len(rs.Moves))
+	for t := n; t >= 0 && t > n-g.Cooldown; t-- {
+		if t >= g.MinRounds && float64(score[t]) > g.Z*math.Sqrt(variance*float64(t)) {
+			return true
+		}
+	}
+	return false
+}
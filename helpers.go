@@ -11,7 +11,6 @@ import (
 	"golang.org/x/oauth2/google"
 	bigquery "google.golang.org/api/bigquery/v2"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/urlfetch"
 	"google.golang.org/appengine/user"
 	"io"
@@ -40,7 +39,7 @@ func RedirectIfNotLoggedIn(w http.ResponseWriter, r *http.Request) bool {
 	if user.Current(c) == nil {
 		redirectURL, err := user.LoginURL(c, r.URL.Path)
 		if err != nil {
-			log.Errorf(c, "Error getting LoginURL: %v", err)
+			logger.Errorf(c, "Error getting LoginURL: %v", err)
 			http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
 			return true
 		}
@@ -119,7 +118,7 @@ func CreateTableInBigQuery(c context.Context, newTable *bigquery.Table) error {
 	// Get BigQuery Service Account Client
 	bqServiceAccountService, err := GetBQServiceAccountClient(c)
 	if err != nil {
-		log.Errorf(c, "Error getting BigQuery Service: %v", err)
+		logger.Errorf(c, "Error getting BigQuery Service: %v", err)
 		return err
 	}
 
@@ -138,7 +137,7 @@ func CreateTableInBigQuery(c context.Context, newTable *bigquery.Table) error {
 		newDataset).
 		Do()
 	if (err != nil) && !ErrorIsAlreadyExists(err) {
-		log.Errorf(c, "There was an error while creating dataset: %v", err)
+		logger.Errorf(c, "There was an error while creating dataset: %v", err)
 		return err
 	}
 
@@ -151,14 +150,57 @@ func CreateTableInBigQuery(c context.Context, newTable *bigquery.Table) error {
 		newTable).
 		Do()
 	if (err != nil) && !ErrorIsAlreadyExists(err) {
-		log.Errorf(c, "There was an error while creating table: %v", err)
+		logger.Errorf(c, "There was an error while creating table: %v", err)
 		return err
 	}
 
+	// Add the columns missing in a table created by an older version
+	if err != nil {
+		return addMissingColumns(c, bigquery.NewTablesService(bqServiceAccountService), newTable)
+	}
+
 	return nil
 }
 
-// Stream data to BigQuery
+// Add the columns of the schema of a table missing in the existing table,
+// which BigQuery would refuse in the rows streamed
+func addMissingColumns(c context.Context, tables *bigquery.TablesService, newTable *bigquery.Table) error {
+	ref := newTable.TableReference
+	table, err := tables.Get(ref.ProjectId, ref.DatasetId, ref.TableId).Do()
+	if err != nil {
+		logger.Errorf(c, "There was an error while getting table: %v", err)
+		return err
+	}
+
+	existing := make(map[string]bool)
+	schema := &bigquery.TableSchema{}
+	if table.Schema != nil {
+		for _, field := range table.Schema.Fields {
+			existing[field.Name] = true
+		}
+		schema.Fields = append(schema.Fields, table.Schema.Fields...)
+	}
+	var missing []string
+	for _, field := range newTable.Schema.Fields {
+		if !existing[field.Name] {
+			schema.Fields = append(schema.Fields, field)
+			missing = append(missing, field.Name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	logger.Infof(c, "Adding columns %v to table %v", missing, ref.TableId)
+	_, err = tables.Patch(ref.ProjectId, ref.DatasetId, ref.TableId, &bigquery.Table{Schema: schema}).Do()
+	if err != nil {
+		logger.Errorf(c, "There was an error while adding columns to table: %v", err)
+	}
+	return err
+}
+
+// Stream data to BigQuery, once: the event sinks retry failed batches
+// (see analytics.go)
 func StreamDataInBigquery(c context.Context, projectId, datasetId, tableId string, req *bigquery.TableDataInsertAllRequest) error {
 
 	if req == nil {
@@ -167,7 +209,7 @@ func StreamDataInBigquery(c context.Context, projectId, datasetId, tableId strin
 
 	bqServiceAccountService, err := GetBQServiceAccountClient(c)
 	if err != nil {
-		log.Errorf(c, "Error getting BigQuery Service: %v", err)
+		logger.Errorf(c, "Error getting BigQuery Service: %v", err)
 		return err
 	}
 
@@ -176,18 +218,8 @@ func StreamDataInBigquery(c context.Context, projectId, datasetId, tableId strin
 		InsertAll(projectId, datasetId, tableId, req).
 		Do()
 	if err != nil {
-		log.Warningf(c, "Error streaming data to Big Query, trying again in 10 seconds: %v", err)
-		time.Sleep(time.Second * 10)
-		resp, err = bigquery.
-			NewTabledataService(bqServiceAccountService).
-			InsertAll(projectId, datasetId, tableId, req).
-			Do()
-		if err != nil {
-			log.Errorf(c, "Error again streaming data to Big Query: %v", err)
-			return err
-		} else {
-			log.Debugf(c, "2nd try was successful")
-		}
+		logger.Errorf(c, "Error streaming data to Big Query: %v", err)
+		return err
 	}
 
 	isError := false
@@ -195,7 +227,7 @@ func StreamDataInBigquery(c context.Context, projectId, datasetId, tableId strin
 		if insertError != nil {
 			for j, e := range insertError.Errors {
 				if (e.DebugInfo != "") || (e.Message != "") || (e.Reason != "") {
-					log.Errorf(c, "BigQuery error %v: %v at %v/%v", e.Reason, e.Message, i, j)
+					logger.Errorf(c, "BigQuery error %v: %v at %v/%v", e.Reason, e.Message, i, j)
 					isError = true
 				}
 			}
@@ -223,7 +255,7 @@ func GetCookieID(w http.ResponseWriter, r *http.Request) string {
 	var id string
 	c := appengine.NewContext(r)
 	cookie, err := r.Cookie("ID")
-	log.Infof(c, "ID cookie: %v", cookie)
+	logger.Infof(c, "ID cookie: %v", cookie)
 	if err != nil || cookie == nil || cookie.Value == "" {
 		ts := strconv.FormatInt(time.Now().UnixNano(), 10)
 		id = MD5(ts + r.RemoteAddr)
@@ -234,10 +266,10 @@ func GetCookieID(w http.ResponseWriter, r *http.Request) string {
 			Domain:  r.Host,
 			Expires: time.Now().Add(time.Hour * 24 * 30),
 		})
-		log.Infof(c, "New Cookie = %v", id)
+		logger.Infof(c, "New Cookie = %v", id)
 	} else {
 		id = cookie.Value
-		log.Infof(c, "Existing ID Cookie = %v", id)
+		logger.Infof(c, "Existing ID Cookie = %v", id)
 	}
 	return id
 }
@@ -251,14 +283,23 @@ func DoesCookieExists(r *http.Request) bool {
 	return true
 }
 
+// Return the Cookie Id of the user's cookies, "" if none
+func RequestCookieId(r *http.Request) string {
+	cookie, err := r.Cookie("ID")
+	if err != nil || cookie == nil {
+		return ""
+	}
+	return cookie.Value
+}
+
 // Utitility to convert JSON object in body
 func UnmarshalRequest(c context.Context, r *http.Request, value interface{}) error {
 	buffer := new(bytes.Buffer)
 	buffer.ReadFrom(r.Body)
 	err := json.Unmarshal(buffer.Bytes(), value)
 	if err != nil {
-		log.Errorf(c, "Error while decoing JSON: %v", err)
-		log.Infof(c, "JSON: %v", buffer.String())
+		logger.Errorf(c, "Error while decoing JSON: %v", err)
+		logger.Infof(c, "JSON: %v", buffer.String())
 		return err
 	}
 	return nil
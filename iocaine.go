@@ -0,0 +1,171 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+)
+
+// Predictor guessing the next user move code from the plays of the
+// current game. Predict returns "" when it has no guess.
+type Predictor struct {
+	Name    string
+	Predict func(rs *RuleSet, userPlays, serverPlays string) string
+}
+
+// Predictors used by the Iocaine Powder meta-strategy
+var predictors = []Predictor{
+	{Name: "frequency", Predict: PredictFrequency},
+	{Name: "markov", Predict: PredictMarkov},
+	{Name: "history", Predict: PredictHistory},
+	{Name: "mirror", Predict: PredictMirror},
+}
+
+// Meta-strategy inspired by the Iocaine Powder bot. Each predictor is
+// used at three levels of "sicilian reasoning": beat the predicted
+// play, beat the user beating that, and beat the user beating that
+// again. Every combination is scored on the last Window rounds of the
+// game as if it had been played, and the best one is followed.
+type IocaineStrategy struct {
+	Window int
+}
+
+func init() {
+	RegisterStrategy(IocaineStrategy{Window: 20})
+}
+
+func (IocaineStrategy) Name() string {
+	return "iocaine"
+}
+
+func (s IocaineStrategy) Play(c context.Context, round Round) (Decision, error) {
+	rs := round.RuleSet
+	guess, name, score, rounds := s.Best(rs, round.UserPlays, round.ServerPlays)
+	if guess == "" || rounds == 0 {
+		return rs.RandomDecision(), nil
+	}
+
+	// The user plays the guess of the best predictor as often as the
+	// predictor won, and the other moves evenly otherwise
+	confidence := float64(score+rounds) / float64(2*rounds)
+	d := make(Distribution)
+	for _, code := range rs.Codes {
+		d[code] = (1 - confidence) / float64(len(rs.Codes)-1)
+	}
+	d[guess] = confidence
+	logger.Debugf(c, "Predictor %v guesses %v", name, rs.Move(guess))
+	return Decision{
+		Play:         rs.Counter(guess),
+		Confidence:   confidence,
+		Distribution: d,
+		Samples:      rounds,
+		Reason:       name,
+	}, nil
+}
+
+// Return the user play/move code guessed by the best predictor and
+// rotation, the server play/move being the counter of the guess, its
+// name (e.g. "markov+1"), its score (wins minus losses) and the number
+// of rounds it was scored on
+func (s IocaineStrategy) Best(rs *RuleSet, userPlays, serverPlays string) (string, string, int, int) {
+
+	n := len(userPlays)
+	if len(serverPlays) < n {
+		n = len(serverPlays)
+	}
+	start := n - s.Window
+	if start < 0 {
+		start = 0
+	}
+
+	bestGuess, bestName, bestScore := "", "", 0
+	for _, p := range predictors {
+
+		// Score the three rotations of the predictor on past rounds
+		var scores [3]int
+		for t := start; t < n; t++ {
+			guess := p.Predict(rs, userPlays[:t], serverPlays[:t])
+			for rotation := range scores {
+				play := rs.Rotate(guess, rotation)
+				switch {
+				case play == "":
+				case rs.Beats(play, userPlays[t:t+1]):
+					scores[rotation]++
+				case rs.Beats(userPlays[t:t+1], play):
+					scores[rotation]--
+				}
+			}
+		}
+
+		// Keep the best rotation with a guess for the next round
+		guess := p.Predict(rs, userPlays[:n], serverPlays[:n])
+		for rotation, score := range scores {
+			play := rs.Rotate(guess, rotation)
+			if play != "" && (bestGuess == "" || score > bestScore) {
+				bestGuess = guess
+				if rotation > 0 {
+					bestGuess = rs.Rotate(guess, rotation-1)
+				}
+				bestName = fmt.Sprintf("%v+%v", p.Name, rotation)
+				bestScore = score
+			}
+		}
+	}
+
+	return bestGuess, bestName, bestScore, n - start
+}
+
+// Return the code of the move beating a predicted move code, after
+// assuming rotation times that the user anticipates it
+func (rs *RuleSet) Rotate(guess string, rotation int) string {
+	play := rs.Code(rs.Counter(guess))
+	for i := 0; i < rotation; i++ {
+		play = rs.Code(rs.Counter(play))
+	}
+	return play
+}
+
+// Predict the most frequent user play/move of the game
+func PredictFrequency(rs *RuleSet, userPlays, serverPlays string) string {
+	freq := make(map[string]int)
+	for i := 0; i < len(userPlays); i++ {
+		freq[userPlays[i:i+1]]++
+	}
+	if len(freq) == 0 {
+		return ""
+	}
+	return rs.MostLikely(rs.NewDistribution(freq))
+}
+
+// Predict the most likely user play/move of the Markov chain strategy
+func PredictMarkov(rs *RuleSet, userPlays, serverPlays string) string {
+	if len(userPlays) == 0 {
+		return ""
+	}
+	d, _, _ := MarkovStrategy{Order: 5, MinSamples: 1}.Predict(rs, userPlays, serverPlays)
+	return rs.MostLikely(d)
+}
+
+// Predict the user play/move that followed the most recent earlier
+// occurrence of the longest suffix of the game
+func PredictHistory(rs *RuleSet, userPlays, serverPlays string) string {
+	n := len(userPlays)
+	if len(serverPlays) < n {
+		n = len(serverPlays)
+	}
+	for k := n - 1; k >= 1; k-- {
+		for j := n - 1; j >= k; j-- {
+			if userPlays[j-k:j] == userPlays[n-k:n] && serverPlays[j-k:j] == serverPlays[n-k:n] {
+				return userPlays[j : j+1]
+			}
+		}
+	}
+	return ""
+}
+
+// Predict that the user anticipates the server by matching the history
+// of the game from the user point of view, and plays the counter of
+// the expected server play/move
+func PredictMirror(rs *RuleSet, userPlays, serverPlays string) string {
+	return rs.Code(rs.Counter(PredictHistory(rs, serverPlays, userPlays)))
+}
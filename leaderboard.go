@@ -0,0 +1,265 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Errors from the leaderboard functions
+var (
+	ErrorUnknownPeriod = errors.New("Unknown leaderboard period")
+	ErrorUnknownSort   = errors.New("Unknown leaderboard sort, use record or rating")
+	ErrorInvalidName   = errors.New("Invalid display name")
+	ErrorMissingCookie = errors.New("Missing player id")
+)
+
+// Periods of the leaderboards
+var LeaderboardPeriods = []string{"all", "week", "day"}
+
+// Number of players shown in a leaderboard, and longest display name
+const (
+	LeaderboardSize   = 20
+	MaxDisplayNameLen = 20
+)
+
+// Structure to store in Datastore the record of a player against the bot
+// in a leaderboard, e.g. "week:2016-W42/US" for the week 42 of 2016 in
+// the United States, or "all/" for all time worldwide. Record is the
+// number of games won minus the games lost, Rating the rating of the
+// player after its last game.
+type LeaderboardEntry struct {
+	Board       string    `json:"-"`
+	CookieId    string    `json:"-"`
+	Games       int       `json:"games" datastore:",noindex"`
+	Wins        int       `json:"wins" datastore:",noindex"`
+	Draws       int       `json:"draws" datastore:",noindex"`
+	Losses      int       `json:"losses" datastore:",noindex"`
+	Record      int       `json:"record"`
+	Rating      float64   `json:"rating"`
+	UpdatedTime time.Time `json:"updated_time" datastore:",noindex"`
+	Rank        int       `json:"rank" datastore:"-"`
+	Name        string    `json:"name" datastore:"-"`
+	You         bool      `json:"you,omitempty" datastore:"-"`
+}
+
+// Structure to store in Datastore the public profile of a player. The
+// display name is only shown in leaderboards if the player set one.
+type Profile struct {
+	CookieId    string    `json:"-"`
+	DisplayName string    `json:"display_name"`
+	UpdatedTime time.Time `json:"updated_time"`
+}
+
+// Return the leaderboard of a period at time t, worldwide if country
+// is "", e.g. "day:2016-10-17/FR"
+func LeaderboardName(period, country string, t time.Time) (string, error) {
+	t = t.UTC()
+	switch period {
+	case "all":
+	case "week":
+		year, week := t.ISOWeek()
+		period = fmt.Sprintf("week:%04d-W%02d", year, week)
+	case "day":
+		period = "day:" + t.Format("2006-01-02")
+	default:
+		return "", ErrorUnknownPeriod
+	}
+	return period + "/" + strings.ToUpper(country), nil
+}
+
+// Record the result of a finished game against the bot in all the
+// leaderboards of the player: of every period, worldwide and in its
+// country if known
+func RecordLeaderboards(c context.Context, cookieId, country, winner string, rating float64) error {
+	countries := []string{""}
+	if country != "" && country != "ZZ" {
+		countries = append(countries, country)
+	}
+	now := time.Now()
+	for _, period := range LeaderboardPeriods {
+		for _, country := range countries {
+			board, _ := LeaderboardName(period, country, now)
+			key := datastore.NewKey(c, "LeaderboardEntry", board+":"+cookieId, 0, nil)
+			err := datastore.RunInTransaction(c, func(tc context.Context) error {
+				entry := LeaderboardEntry{Board: board, CookieId: cookieId}
+				if err := datastore.Get(tc, key, &entry); err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+				entry.Games++
+				switch winner {
+				case "user":
+					entry.Wins++
+				case "server":
+					entry.Losses++
+				default:
+					entry.Draws++
+				}
+				entry.Record = entry.Wins - entry.Losses
+				entry.Rating = rating
+				entry.UpdatedTime = now
+				_, err := datastore.Put(tc, key, &entry)
+				return err
+			}, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return the best players of a leaderboard, by record or by rating (see
+// index.yaml), with their display names
+func GetLeaderboard(c context.Context, board, sort string) ([]LeaderboardEntry, error) {
+	var order string
+	switch sort {
+	case "record":
+		order = "-Record"
+	case "rating":
+		order = "-Rating"
+	default:
+		return nil, ErrorUnknownSort
+	}
+
+	var entries []LeaderboardEntry
+	q := datastore.NewQuery("LeaderboardEntry").Filter("Board =", board).Order(order).Limit(LeaderboardSize)
+	if _, err := q.GetAll(c, &entries); err != nil {
+		return nil, err
+	}
+
+	// Names of the players who opted in
+	keys := make([]*datastore.Key, len(entries))
+	for i, entry := range entries {
+		keys[i] = datastore.NewKey(c, "Profile", entry.CookieId, 0, nil)
+	}
+	profiles := make([]Profile, len(entries))
+	err := datastore.GetMulti(c, keys, profiles)
+	merr, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Rank = i + 1
+		entries[i].Name = "Anonymous"
+		if (!ok || merr[i] == nil) && profiles[i].DisplayName != "" {
+			entries[i].Name = profiles[i].DisplayName
+		}
+	}
+	return entries, nil
+}
+
+// Return a display name without leading, trailing or repeated spaces,
+// or an error if it is too long or has control characters
+func CleanDisplayName(name string) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	if len([]rune(name)) > MaxDisplayNameLen {
+		return "", ErrorInvalidName
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return "", ErrorInvalidName
+		}
+	}
+	return name, nil
+}
+
+// Set the display name of a player, or remove it if name is ""
+func SetDisplayName(c context.Context, cookieId, name string) (*Profile, error) {
+	if cookieId == "" {
+		return nil, ErrorMissingCookie
+	}
+	name, err := CleanDisplayName(name)
+	if err != nil {
+		return nil, err
+	}
+	profile := &Profile{CookieId: cookieId, DisplayName: name, UpdatedTime: time.Now()}
+	key := datastore.NewKey(c, "Profile", cookieId, 0, nil)
+	if name == "" {
+		return profile, datastore.Delete(c, key)
+	}
+	_, err = datastore.Put(c, key, profile)
+	return profile, err
+}
+
+// Provide a leaderboard of the players against the bot: of a period (all,
+// week or day parameter, all by default), worldwide or of a country
+// (country parameter), sorted by record or rating (sort parameter,
+// record by default). The player (ID cookie) is flagged if listed.
+// Return the leaderboard in JSON in HTTP response
+func LeaderboardHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Leaderboard Handler")
+
+	period, sort := r.FormValue("period"), r.FormValue("sort")
+	if period == "" {
+		period = "all"
+	}
+	if sort == "" {
+		sort = "record"
+	}
+
+	board, err := LeaderboardName(period, r.FormValue("country"), time.Now())
+	if err != nil {
+		logger.Errorf(c, "Error, invalid leaderboard: %v", err)
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := GetLeaderboard(c, board, sort)
+	if err == ErrorUnknownSort {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.Errorf(c, "Error while getting leaderboard %v: %v", board, err)
+		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cookieId := RequestCookieId(r)
+	for i := range entries {
+		entries[i].You = cookieId != "" && entries[i].CookieId == cookieId
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(map[string]interface{}{
+		"board":   board,
+		"sort":    sort,
+		"entries": entries,
+	}))
+
+}
+
+// Opt in to the leaderboards with a display name (name parameter) for
+// the player (ID cookie), or opt out with an empty name
+// Return the profile in JSON in HTTP response
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Profile Handler")
+
+	profile, err := SetDisplayName(c, RequestCookieId(r), r.FormValue("name"))
+	if err == ErrorMissingCookie || err == ErrorInvalidName {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.Errorf(c, "Error while setting display name: %v", err)
+		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(profile))
+
+}
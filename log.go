@@ -0,0 +1,84 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	aelog "google.golang.org/appengine/log"
+	"io"
+	stdlog "log"
+	"os"
+)
+
+// Logger of the application, by level, writing to the logs of the
+// request of the context
+type Logger interface {
+	Debugf(c context.Context, format string, args ...interface{})
+	Infof(c context.Context, format string, args ...interface{})
+	Warningf(c context.Context, format string, args ...interface{})
+	Errorf(c context.Context, format string, args ...interface{})
+}
+
+// Logger of the application: the App Engine logs on App Engine, the
+// standard error otherwise (e.g. in tests, commands and the standalone
+// server). Commands replace it to silence the strategies.
+var logger Logger = NewLogger()
+
+// Return the logger of the environment the application runs in
+func NewLogger() Logger {
+	if appengine.IsAppEngine() {
+		return AppEngineLogger{}
+	}
+	return NewStdLogger(os.Stderr)
+}
+
+// Logger writing to the App Engine logs of the request of the context
+type AppEngineLogger struct{}
+
+func (AppEngineLogger) Debugf(c context.Context, format string, args ...interface{}) {
+	aelog.Debugf(c, format, args...)
+}
+
+func (AppEngineLogger) Infof(c context.Context, format string, args ...interface{}) {
+	aelog.Infof(c, format, args...)
+}
+
+func (AppEngineLogger) Warningf(c context.Context, format string, args ...interface{}) {
+	aelog.Warningf(c, format, args...)
+}
+
+func (AppEngineLogger) Errorf(c context.Context, format string, args ...interface{}) {
+	aelog.Errorf(c, format, args...)
+}
+
+// Logger writing lines prefixed by the time and the level, ignoring the
+// context
+type StdLogger struct {
+	*stdlog.Logger
+}
+
+// Return a logger writing to w
+func NewStdLogger(w io.Writer) StdLogger {
+	return StdLogger{stdlog.New(w, "", stdlog.LstdFlags)}
+}
+
+func (l StdLogger) Debugf(c context.Context, format string, args ...interface{}) {
+	l.logf("DEBUG", format, args...)
+}
+
+func (l StdLogger) Infof(c context.Context, format string, args ...interface{}) {
+	l.logf("INFO", format, args...)
+}
+
+func (l StdLogger) Warningf(c context.Context, format string, args ...interface{}) {
+	l.logf("WARNING", format, args...)
+}
+
+func (l StdLogger) Errorf(c context.Context, format string, args ...interface{}) {
+	l.logf("ERROR", format, args...)
+}
+
+func (l StdLogger) logf(level, format string, args ...interface{}) {
+	l.Printf("%v: %v", level, fmt.Sprintf(format, args...))
+}
@@ -2,25 +2,83 @@
 package main
 
 import (
+	"errors"
+	"google.golang.org/appengine"
 	"net/http"
 )
 
+// Error of the features needing Datastore outside App Engine
+var (
+	ErrorNotOnAppEngine = errors.New("Only available on App Engine")
+)
+
 // Main init function to assign paths to handlers
 func init() {
 
 	// Home page (& catch-all)
 	http.HandleFunc("/", HomeHandler)
 
+	// API to start a new game
+	http.HandleFunc("/start", StartGameHandler)
+
 	// API to get next server play
 	http.HandleFunc("/play", PlayHandler)
 
-	// API to record previous play
+	// API to record the user play of a round
 	http.HandleFunc("/record", RecordPlayHandler)
 
-	// API to record finished game
-	http.HandleFunc("/game", RecordGameHandler)
+	// APIs to get the state of a game, and the last plays of a player
+	http.HandleFunc("/game", GameHandler)
+	http.HandleFunc("/history", HistoryHandler)
+
+	// API to get the predefined game rules
+	http.HandleFunc("/rules", RulesHandler)
+
+	// APIs of the player-vs-player mode: join a match, play a move,
+	// and wait for updates by long polling or over a WebSocket (only
+	// outside App Engine)
+	http.HandleFunc("/pvp/join", JoinMatchHandler)
+	http.HandleFunc("/pvp/move", MatchMoveHandler)
+	http.HandleFunc("/pvp/poll", MatchPollHandler)
+	http.HandleFunc("/pvp/ws", MatchSocketHandler)
+
+	// The next APIs keep their data in Datastore, and only work on App
+	// Engine: the standalone server answers them with 501 (see README)
+
+	// API to get the ratings of the player and of the strategies
+	http.HandleFunc("/ratings", appEngineOnly(RatingsHandler))
+
+	// Count the games against the strategies in their ratings (cron only)
+	http.HandleFunc("/cron/ratings", appEngineOnly(UpdateStrategyRatingsHandler))
+
+	// Send the queued plays and games to BigQuery (cron only)
+	http.HandleFunc("/cron/analytics", appEngineOnly(SendEventsHandler))
+
+	// APIs to get the leaderboards, and to opt in with a display name
+	http.HandleFunc("/leaderboard", appEngineOnly(LeaderboardHandler))
+	http.HandleFunc("/profile", appEngineOnly(ProfileHandler))
+
+	// APIs of the tournaments: get one, create one, register, start it
+	// and report the result of a match played outside of the game
+	http.HandleFunc("/tournament", appEngineOnly(TournamentHandler))
+	http.HandleFunc("/tournament/create", appEngineOnly(CreateTournamentHandler))
+	http.HandleFunc("/tournament/register", appEngineOnly(RegisterTournamentHandler))
+	http.HandleFunc("/tournament/start", appEngineOnly(StartTournamentHandler))
+	http.HandleFunc("/tournament/report", appEngineOnly(ReportTournamentHandler))
 
 	// Create Table in BigQuery (admin only)
-	http.HandleFunc("/init", CreateBigQueryTableHandler)
+	http.HandleFunc("/init", appEngineOnly(CreateBigQueryTableHandler))
+
+}
 
+// Return a handler answering 501 Not Implemented instead of calling h
+// outside App Engine, where Datastore is not available
+func appEngineOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !appengine.IsAppEngine() {
+			http.Error(w, "Error: "+ErrorNotOnAppEngine.Error(), http.StatusNotImplemented)
+			return
+		}
+		h(w, r)
+	}
 }
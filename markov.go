@@ -0,0 +1,68 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"golang.org/x/net/context"
+)
+
+// Strategy predicting the next user play/move with a variable-order
+// Markov chain over the joint user and server plays of the current game.
+// Contexts of Order down to 1 are tried, the longest one followed by at
+// least MinSamples plays wins.
+type MarkovStrategy struct {
+	Order      int
+	MinSamples int
+}
+
+func init() {
+	RegisterStrategy(MarkovStrategy{Order: 5, MinSamples: 2})
+}
+
+func (MarkovStrategy) Name() string {
+	return "markov"
+}
+
+func (m MarkovStrategy) Play(c context.Context, round Round) (Decision, error) {
+	d, _, samples := m.Predict(round.RuleSet, round.UserPlays, round.ServerPlays)
+	decision := round.RuleSet.BestResponse(d)
+	decision.Samples = samples
+	return decision, nil
+}
+
+// Return the distribution of the next user play/move, the order of the
+// context used (0 if none matched) and the number of samples behind it
+func (m MarkovStrategy) Predict(rs *RuleSet, userPlays, serverPlays string) (Distribution, int, int) {
+
+	// Pair user and server plays: round i is userPlays[i] + serverPlays[i]
+	n := len(userPlays)
+	if len(serverPlays) < n {
+		n = len(serverPlays)
+	}
+	userPlays = userPlays[:n]
+	serverPlays = serverPlays[:n]
+
+	// Back off from the longest context to the shortest one
+	for k := m.Order; k >= 1; k-- {
+		if k >= n {
+			continue
+		}
+		freq := make(map[string]int)
+		samples := 0
+		for j := k; j < n; j++ {
+			if userPlays[j-k:j] == userPlays[n-k:] && serverPlays[j-k:j] == serverPlays[n-k:] {
+				freq[userPlays[j:j+1]]++
+				samples++
+			}
+		}
+		if samples >= m.MinSamples {
+			return rs.NewDistribution(freq), k, samples
+		}
+	}
+
+	// Without any matching context, use the frequency of user plays
+	freq := make(map[string]int)
+	for i := 0; i < n; i++ {
+		freq[userPlays[i:i+1]]++
+	}
+	return rs.NewDistribution(freq), 0, n
+}
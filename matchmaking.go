@@ -0,0 +1,184 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Player waiting in the matchmaking queue. Players are only paired with
+// players of the same queue, i.e. playing with the same rules.
+type Ticket struct {
+	CookieId string
+	Rating   float64
+	Queue    string
+	Client   ClientInfo
+	Joined   time.Time
+	Seen     time.Time
+}
+
+// Pairing of two players made by a matchmaker, or of a single player
+// with the bot if Bot is set. Id is the id of the match to play.
+type Pairing struct {
+	Id      int64
+	Queue   string
+	Players []Ticket
+	Bot     bool
+}
+
+// Matchmaking service pairing the players of a queue
+type Matchmaker interface {
+	// Put a player in the queue, or refresh its ticket if already in it
+	Enqueue(t Ticket)
+	// Remove a player from the queue
+	Cancel(cookieId string)
+	// Pair the players waiting in the queue at time now, and return the
+	// new pairings
+	Pair(now time.Time) []Pairing
+	// Return the pairing of a player, once, if it was paired
+	Pairing(cookieId string) (Pairing, bool)
+}
+
+// In-process matchmaking queue pairing players by rating and wait time.
+// Two players can be paired if their ratings differ by at most Window,
+// growing by WindowGrowth points per second the oldest one waited.
+// Players waiting for more than BotTimeout are paired with the bot, and
+// players not seen (i.e. who stopped asking for a pairing) for more than
+// Expiry leave the queue.
+type Queue struct {
+	Window       float64
+	WindowGrowth float64
+	BotTimeout   time.Duration
+	Expiry       time.Duration
+
+	mutex    sync.Mutex
+	tickets  map[string]Ticket
+	pairings map[string]Pairing
+	paired   map[string]time.Time
+}
+
+// Return a new matchmaking queue with the default settings
+func NewQueue() *Queue {
+	return &Queue{
+		Window:       100,
+		WindowGrowth: 20,
+		BotTimeout:   30 * time.Second,
+		Expiry:       PollTimeout + 10*time.Second,
+		tickets:      make(map[string]Ticket),
+		pairings:     make(map[string]Pairing),
+		paired:       make(map[string]time.Time),
+	}
+}
+
+func (q *Queue) Enqueue(t Ticket) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, ok := q.pairings[t.CookieId]; ok {
+		return
+	}
+	if old, ok := q.tickets[t.CookieId]; ok && old.Queue == t.Queue {
+		t.Joined = old.Joined
+	}
+	if t.Joined.IsZero() {
+		t.Joined = t.Seen
+	}
+	q.tickets[t.CookieId] = t
+}
+
+func (q *Queue) Cancel(cookieId string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.tickets, cookieId)
+	delete(q.pairings, cookieId)
+	delete(q.paired, cookieId)
+}
+
+func (q *Queue) Pair(now time.Time) []Pairing {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Forget the players who left
+	for cookieId, t := range q.tickets {
+		if now.Sub(t.Seen) > q.Expiry {
+			delete(q.tickets, cookieId)
+		}
+	}
+	for cookieId, pairedTime := range q.paired {
+		if now.Sub(pairedTime) > q.Expiry {
+			delete(q.pairings, cookieId)
+			delete(q.paired, cookieId)
+		}
+	}
+
+	// Serve the players who waited the longest first
+	tickets := make([]Ticket, 0, len(q.tickets))
+	for _, t := range q.tickets {
+		tickets = append(tickets, t)
+	}
+	sort.Slice(tickets, func(i, j int) bool {
+		return tickets[i].Joined.Before(tickets[j].Joined)
+	})
+
+	var pairings []Pairing
+	done := make(map[string]bool)
+	for i, a := range tickets {
+		if done[a.CookieId] {
+			continue
+		}
+
+		// Closest rating within the window of the player
+		window := q.Window + q.WindowGrowth*now.Sub(a.Joined).Seconds()
+		best, bestDiff := -1, math.Inf(1)
+		for j := i + 1; j < len(tickets); j++ {
+			b := tickets[j]
+			if done[b.CookieId] || b.Queue != a.Queue {
+				continue
+			}
+			diff := math.Abs(a.Rating - b.Rating)
+			if diff <= window && diff < bestDiff {
+				best, bestDiff = j, diff
+			}
+		}
+
+		var p Pairing
+		switch {
+		case best >= 0:
+			p = Pairing{Queue: a.Queue, Players: []Ticket{a, tickets[best]}}
+		case now.Sub(a.Joined) >= q.BotTimeout:
+			p = Pairing{Queue: a.Queue, Players: []Ticket{a}, Bot: true}
+		default:
+			continue
+		}
+		p.Id = NewPairingId()
+		for _, t := range p.Players {
+			done[t.CookieId] = true
+			delete(q.tickets, t.CookieId)
+			q.pairings[t.CookieId] = p
+			q.paired[t.CookieId] = now
+		}
+		pairings = append(pairings, p)
+	}
+	return pairings
+}
+
+func (q *Queue) Pairing(cookieId string) (Pairing, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	p, ok := q.pairings[cookieId]
+	delete(q.pairings, cookieId)
+	delete(q.paired, cookieId)
+	return p, ok
+}
+
+// Return a random positive id for a pairing
+func NewPairingId() int64 {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.BigEndian.Uint64(b)>>2) + 1
+}
@@ -0,0 +1,112 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Return a queue with fixed settings, and a time to join it at
+func newTestQueue() (*Queue, time.Time) {
+	q := NewQueue()
+	q.Window = 100
+	q.WindowGrowth = 10
+	q.BotTimeout = 30 * time.Second
+	q.Expiry = time.Minute
+	return q, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Return the cookie ids of the players of a pairing
+func pairedIds(p Pairing) []string {
+	var ids []string
+	for _, t := range p.Players {
+		ids = append(ids, t.CookieId)
+	}
+	return ids
+}
+
+func TestQueuePairsClosestRating(t *testing.T) {
+	q, now := newTestQueue()
+	q.Enqueue(Ticket{CookieId: "a", Rating: 1500, Queue: "classic", Seen: now})
+	q.Enqueue(Ticket{CookieId: "b", Rating: 1590, Queue: "classic", Seen: now.Add(time.Second)})
+	q.Enqueue(Ticket{CookieId: "c", Rating: 1520, Queue: "classic", Seen: now.Add(2 * time.Second)})
+
+	pairings := q.Pair(now.Add(2 * time.Second))
+	if len(pairings) != 1 {
+		t.Fatalf("Pair made %v pairings, want 1", len(pairings))
+	}
+	p := pairings[0]
+	if ids := pairedIds(p); len(ids) != 2 || ids[0] != "a" || ids[1] != "c" || p.Bot || p.Id <= 0 {
+		t.Errorf("Pairing %+v, want a and c", p)
+	}
+
+	// Each player gets its pairing once
+	for _, cookieId := range []string{"a", "c"} {
+		if got, ok := q.Pairing(cookieId); !ok || got.Id != p.Id {
+			t.Errorf("Pairing(%v) = %+v, %v, want %v", cookieId, got, ok, p.Id)
+		}
+		if _, ok := q.Pairing(cookieId); ok {
+			t.Errorf("Pairing(%v) returned twice", cookieId)
+		}
+	}
+	if _, ok := q.Pairing("b"); ok {
+		t.Errorf("Pairing(b) found, want b waiting")
+	}
+}
+
+func TestQueueSeparatesQueues(t *testing.T) {
+	q, now := newTestQueue()
+	q.Enqueue(Ticket{CookieId: "a", Rating: 1500, Queue: "classic", Seen: now})
+	q.Enqueue(Ticket{CookieId: "b", Rating: 1500, Queue: "rpsls", Seen: now})
+	if pairings := q.Pair(now); len(pairings) != 0 {
+		t.Errorf("Pair made %+v, want players of different queues waiting", pairings)
+	}
+}
+
+func TestQueueWindowGrows(t *testing.T) {
+	q, now := newTestQueue()
+	q.Enqueue(Ticket{CookieId: "a", Rating: 1500, Queue: "classic", Seen: now})
+	q.Enqueue(Ticket{CookieId: "b", Rating: 1700, Queue: "classic", Seen: now})
+
+	// 200 points apart: paired once the window grew by 100 points
+	if pairings := q.Pair(now.Add(5 * time.Second)); len(pairings) != 0 {
+		t.Fatalf("Pair made %+v after 5s, want none", pairings)
+	}
+	q.Enqueue(Ticket{CookieId: "a", Rating: 1500, Queue: "classic", Seen: now.Add(10 * time.Second)})
+	q.Enqueue(Ticket{CookieId: "b", Rating: 1700, Queue: "classic", Seen: now.Add(10 * time.Second)})
+	if pairings := q.Pair(now.Add(10 * time.Second)); len(pairings) != 1 || len(pairings[0].Players) != 2 {
+		t.Errorf("Pair made %+v after 10s, want a and b", pairings)
+	}
+}
+
+func TestQueueBotAndExpiry(t *testing.T) {
+	q, now := newTestQueue()
+	q.Enqueue(Ticket{CookieId: "a", Rating: 1500, Queue: "classic", Seen: now})
+	q.Enqueue(Ticket{CookieId: "gone", Rating: 1500, Queue: "rpsls", Seen: now})
+
+	// The player still asking is paired with the bot after BotTimeout,
+	// the other one left the queue after Expiry
+	later := now.Add(65 * time.Second)
+	q.Enqueue(Ticket{CookieId: "a", Rating: 1500, Queue: "classic", Seen: later})
+	pairings := q.Pair(later)
+	if len(pairings) != 1 || !pairings[0].Bot || pairings[0].Players[0].CookieId != "a" {
+		t.Fatalf("Pair made %+v, want a with the bot", pairings)
+	}
+	if _, ok := q.Pairing("gone"); ok {
+		t.Errorf("Pairing(gone) found, want expired")
+	}
+	q.Enqueue(Ticket{CookieId: "gone", Rating: 1500, Queue: "rpsls", Seen: later})
+	if pairings := q.Pair(later); len(pairings) != 0 {
+		t.Errorf("Pair made %+v, want the player joining again waiting", pairings)
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	q, now := newTestQueue()
+	q.Enqueue(Ticket{CookieId: "a", Rating: 1500, Queue: "classic", Seen: now})
+	q.Cancel("a")
+	q.Enqueue(Ticket{CookieId: "b", Rating: 1500, Queue: "classic", Seen: now})
+	if pairings := q.Pair(now); len(pairings) != 0 {
+		t.Errorf("Pair made %+v, want the cancelled player out of the queue", pairings)
+	}
+}
@@ -0,0 +1,54 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"golang.org/x/net/context"
+)
+
+// Strategy blending a personal model, built from the previous plays of
+// the current player, with the crowd model built from the plays of all
+// players. The personal model weighs n/(n+PriorWeight) where n is the
+// number of plays of the player in the same conditions, so new players
+// start with the crowd model only.
+type PersonalStrategy struct {
+	PriorWeight float64
+}
+
+func init() {
+	RegisterStrategy(PersonalStrategy{PriorWeight: 10})
+}
+
+func (PersonalStrategy) Name() string {
+	return "personal"
+}
+
+func (s PersonalStrategy) Play(c context.Context, round Round) (Decision, error) {
+
+	// Crowd model, from all players
+	rs := round.RuleSet
+	crowdFreq, crowdN, err := GetContextFrequencies(c, rs, round.UserPlays, round.ServerPlays, "")
+	if err != nil {
+		return Decision{}, err
+	}
+
+	// Personal model, from the plays of this player only
+	personalFreq, personalN := map[string]int{}, 0
+	if round.CookieId != "" {
+		personalFreq, personalN, err = GetContextFrequencies(c, rs, round.UserPlays, round.ServerPlays, round.CookieId)
+		if err != nil {
+			return Decision{}, err
+		}
+	}
+
+	// If no plays/moves at all, return default (random) value
+	if crowdN+personalN == 0 {
+		logger.Infof(c, "No statistics, providing default value")
+		return rs.RandomDecision(), nil
+	}
+
+	w := float64(personalN) / (float64(personalN) + s.PriorWeight)
+	logger.Debugf(c, "Personal plays: %v, crowd plays: %v, personal weight: %v", personalN, crowdN, w)
+	decision := rs.BestResponse(rs.Blend(rs.NewDistribution(personalFreq), rs.NewDistribution(crowdFreq), w))
+	decision.Samples = crowdN
+	return decision, nil
+}
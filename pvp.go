@@ -0,0 +1,710 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+	"google.golang.org/appengine"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Errors from the player-vs-player functions
+var (
+	ErrorMatchNotFound  = errors.New("Match not found")
+	ErrorInvalidMatchId = errors.New("Invalid match id")
+	ErrorNotInMatch     = errors.New("Player is not in this match")
+	ErrorAlreadyPlayed  = errors.New("Player already played this round")
+)
+
+// Name reported as strategy for the plays of a human opponent
+const HumanStrategyName = "human"
+
+// Play recorded for a player who didn't play a round in time
+const NoMove = "-"
+
+// Time limits of a match: to play a round, and for a long polling
+// request to wait for an update
+const (
+	RoundTimeout = 15 * time.Second
+	PollTimeout  = 25 * time.Second
+)
+
+// Player of a match. The move of the current round is kept secret until
+// both players played, the opponent only knows the player is ready.
+// Present is set once the player opened the match.
+type MatchPlayer struct {
+	CookieId string     `json:"-"`
+	Plays    string     `json:"plays"`
+	Wins     int        `json:"wins"`
+	Ready    bool       `json:"ready"`
+	Present  bool       `json:"present"`
+	Move     string     `json:"-" datastore:",noindex"`
+	Client   ClientInfo `json:"-" datastore:",noindex"`
+}
+
+// Structure to store a player-vs-player match in Datastore. Both players
+// play each round at the same time, the server resolves the round once
+// both played or once the time limit passed, a player who didn't play
+// in time losing the round. The first round starts once both players
+// are present (Deadline is zero until then). The version increases with
+// every update so players can wait for the next one. Matches of a
+// tournament record the tournament id and the index of the tournament
+// match they are played for.
+type Match struct {
+	Id              int64       `json:"id" datastore:"-"`
+	A               MatchPlayer `json:"a"`
+	B               MatchPlayer `json:"b"`
+	Rules           GameRules   `json:"rules"`
+	RuleSetName     string      `json:"rule_set" datastore:"RuleSet"`
+	Round           int         `json:"round"`
+	Draws           int         `json:"draws"`
+	LastWinner      string      `json:"last_winner,omitempty"`
+	Winner          string      `json:"winner,omitempty"`
+	Finished        bool        `json:"finished"`
+	Deadline        time.Time   `json:"deadline"`
+	Version         int         `json:"version"`
+	Tournament      int64       `json:"tournament,omitempty"`
+	TournamentMatch int         `json:"tournament_match,omitempty"`
+	CreatedTime     time.Time   `json:"created_time"`
+	UpdatedTime     time.Time   `json:"updated_time"`
+	You             string      `json:"you,omitempty" datastore:"-"`
+	SecondsLeft     int         `json:"seconds_left,omitempty" datastore:"-"`
+}
+
+// Return the rule set of the match, the classic one if unknown
+func (m *Match) RuleSet() *RuleSet {
+	rs, err := GetRuleSet(m.RuleSetName)
+	if err != nil {
+		return Classic
+	}
+	return rs
+}
+
+// Return the side ("a" or "b") of a player in the match, or "" if the
+// player is not in it
+func (m *Match) Side(cookieId string) string {
+	switch {
+	case cookieId == "":
+		return ""
+	case m.A.CookieId == cookieId:
+		return "a"
+	case m.B.CookieId == cookieId:
+		return "b"
+	}
+	return ""
+}
+
+// Return the player and the opponent of a side of the match
+func (m *Match) Players(side string) (*MatchPlayer, *MatchPlayer) {
+	if side == "b" {
+		return &m.B, &m.A
+	}
+	return &m.A, &m.B
+}
+
+// Return the match as seen by a player
+func (m *Match) View(cookieId string) *Match {
+	m.You = m.Side(cookieId)
+	if !m.Finished && !m.Deadline.IsZero() {
+		m.SecondsLeft = int(m.Deadline.Sub(time.Now()).Seconds() + 0.5)
+		if m.SecondsLeft < 0 {
+			m.SecondsLeft = 0
+		}
+	}
+	return m
+}
+
+// Resolve the current round once both players played or the time limit
+// passed, and finish the match once it is over according to its rules.
+// A match where neither player played in time is abandoned as a draw.
+// Return true if the round was resolved.
+func (m *Match) Resolve(now time.Time) bool {
+	if m.Finished || m.Deadline.IsZero() {
+		return false
+	}
+	a, b := m.A.Move, m.B.Move
+	if (a == "" || b == "") && now.Before(m.Deadline) {
+		return false
+	}
+
+	rs := m.RuleSet()
+	switch {
+	case a != "" && (b == "" || rs.Beats(a, b)):
+		m.A.Wins++
+		m.LastWinner = "a"
+	case b != "" && (a == "" || rs.Beats(b, a)):
+		m.B.Wins++
+		m.LastWinner = "b"
+	default:
+		m.Draws++
+		m.LastWinner = "deuce"
+	}
+	if a == "" {
+		a = NoMove
+	}
+	if b == "" {
+		b = NoMove
+	}
+	m.A.Plays += a
+	m.B.Plays += b
+	m.A.Move, m.A.Ready = "", false
+	m.B.Move, m.B.Ready = "", false
+	m.Round++
+	m.Deadline = now.Add(RoundTimeout)
+
+	if a == NoMove && b == NoMove {
+		m.Finished, m.Winner = true, "draw"
+		return true
+	}
+	finished, winner := m.Rules.Finished(m.A.Wins, m.B.Wins, m.Draws)
+	if finished {
+		m.Finished = true
+		switch winner {
+		case "user":
+			m.Winner = "a"
+		case "server":
+			m.Winner = "b"
+		default:
+			m.Winner = winner
+		}
+	}
+	return true
+}
+
+// Return the result of the finished match from the point of view of the
+// player of a side
+func (m *Match) Result(side string) GameResult {
+	player, opponent := m.Players(side)
+	winner := m.Winner
+	switch winner {
+	case side:
+		winner = "user"
+	case "a", "b":
+		winner = "server"
+	}
+	return GameResult{
+		CookieId:    player.CookieId,
+		Opponent:    opponent.CookieId,
+		RuleSet:     m.RuleSetName,
+		UserPlays:   player.Plays,
+		ServerPlays: opponent.Plays,
+		Winner:      winner,
+		Time:        m.UpdatedTime,
+	}
+}
+
+// Return the match with this id from the play store
+func GetMatch(c context.Context, id int64) (*Match, error) {
+	if id <= 0 {
+		return nil, ErrorInvalidMatchId
+	}
+	return playStore.GetMatch(c, id)
+}
+
+// Update the match with this id in the play store. The match is only
+// stored, with a new version, if update returns true.
+func UpdateMatch(c context.Context, id int64, update func(m *Match) (bool, error)) (*Match, bool, error) {
+	if id <= 0 {
+		return nil, false, ErrorInvalidMatchId
+	}
+	return playStore.UpdateMatch(c, id, func(m *Match) (bool, error) {
+		changed, err := update(m)
+		if err != nil || !changed {
+			return false, err
+		}
+		m.Version++
+		m.UpdatedTime = time.Now()
+		return true, nil
+	})
+}
+
+// Return the queue of the players who can play together, the ones
+// playing with the same rules and rule set
+func MatchQueue(rules GameRules, ruleSet *RuleSet) string {
+	return ruleSet.Name + "/" + rules.Name + "/" + rules.Describe()
+}
+
+// Matchmaking queue of this instance
+var matchmaker Matchmaker = NewQueue()
+
+// Put the player of a ticket in the matchmaking queue, and wait up to
+// timeout for it to be paired with an opponent or with the bot
+func WaitPairing(t Ticket, timeout time.Duration) (Pairing, bool) {
+	matchmaker.Enqueue(t)
+	end := time.Now().Add(timeout)
+	for {
+		for _, p := range matchmaker.Pair(time.Now()) {
+			for _, player := range p.Players {
+				pairingUpdates.Notify(player.CookieId)
+			}
+		}
+		if p, ok := matchmaker.Pairing(t.CookieId); ok {
+			return p, true
+		}
+		left := end.Sub(time.Now())
+		if left <= 0 {
+			return Pairing{}, false
+		}
+		if left > time.Second {
+			left = time.Second
+		}
+		pairingUpdates.Wait(t.CookieId, left)
+	}
+}
+
+// Return a new match for a pairing of two players, both present, with
+// the rules of their queue
+func NewMatch(p Pairing, rules GameRules, ruleSet *RuleSet) *Match {
+	return &Match{
+		Id:          p.Id,
+		A:           MatchPlayer{CookieId: p.Players[0].CookieId, Client: p.Players[0].Client, Present: true},
+		B:           MatchPlayer{CookieId: p.Players[1].CookieId, Client: p.Players[1].Client, Present: true},
+		Rules:       rules,
+		RuleSetName: ruleSet.Name,
+		Deadline:    time.Now().Add(RoundTimeout),
+		CreatedTime: time.Now(),
+		UpdatedTime: time.Now(),
+	}
+}
+
+// Store a new match under its id in the play store, unless it already
+// exists, and return the stored match
+func StartMatch(c context.Context, match *Match) (*Match, error) {
+	return playStore.StartMatch(c, match)
+}
+
+// Mark a player present in a match, starting the first round once both
+// players are
+func EnterMatch(c context.Context, id int64, cookieId string) (*Match, error) {
+	m, updated, err := UpdateMatch(c, id, func(m *Match) (bool, error) {
+		side := m.Side(cookieId)
+		if side == "" {
+			return false, ErrorNotInMatch
+		}
+		player, opponent := m.Players(side)
+		if player.Present {
+			return false, nil
+		}
+		player.Present = true
+		if opponent.Present {
+			m.Deadline = time.Now().Add(RoundTimeout)
+		}
+		return true, nil
+	})
+	if updated {
+		matchUpdates.Notify(strconv.FormatInt(id, 10))
+	}
+	return m, err
+}
+
+// Play the move of a player in the current round of a match, resolving
+// the round if the opponent already played
+func PlayMatchMove(c context.Context, id int64, cookieId, move string) (*Match, error) {
+	resolved := false
+	m, _, err := UpdateMatch(c, id, func(m *Match) (bool, error) {
+		side := m.Side(cookieId)
+		if side == "" {
+			return false, ErrorNotInMatch
+		}
+		if m.Finished {
+			return false, ErrorGameFinished
+		}
+		player, _ := m.Players(side)
+		if player.Move != "" {
+			return false, ErrorAlreadyPlayed
+		}
+		code := m.RuleSet().Code(move)
+		if code == "" {
+			return false, ErrorUnknownPlay
+		}
+		player.Move, player.Ready = code, true
+		resolved = m.Resolve(time.Now())
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resolved {
+		RecordMatchRound(c, m)
+	}
+	matchUpdates.Notify(strconv.FormatInt(id, 10))
+	return m, nil
+}
+
+// Resolve the current round of a match if its time limit passed
+func ResolveMatch(c context.Context, id int64) (*Match, error) {
+	m, resolved, err := UpdateMatch(c, id, func(m *Match) (bool, error) {
+		return m.Resolve(time.Now()), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resolved {
+		RecordMatchRound(c, m)
+		matchUpdates.Notify(strconv.FormatInt(id, 10))
+	}
+	return m, nil
+}
+
+// Wait up to timeout for a version of a match newer than version, and
+// return the match. The round is resolved while waiting if its time
+// limit passed.
+func WaitMatch(c context.Context, id int64, version int, timeout time.Duration) (*Match, error) {
+	end := time.Now().Add(timeout)
+	for {
+		m, err := GetMatch(c, id)
+		if err != nil {
+			return nil, err
+		}
+		if !m.Finished && time.Now().After(m.Deadline) {
+			if m, err = ResolveMatch(c, id); err != nil {
+				return nil, err
+			}
+		}
+		left := end.Sub(time.Now())
+		if m.Version > version || left <= 0 {
+			return m, nil
+		}
+
+		// Updates made by this instance are notified at once, the
+		// ones made by other instances are read at least every second
+		if left > time.Second {
+			left = time.Second
+		}
+		matchUpdates.Wait(strconv.FormatInt(id, 10), left)
+	}
+}
+
+// Record the last round of a match for both players in the play store
+// and the analytics, each player being the "user" of its own plays, and
+// the match once finished. Rounds a player missed are not recorded as
+// plays.
+func RecordMatchRound(c context.Context, m *Match) {
+	for _, side := range []string{"a", "b"} {
+		player, opponent := m.Players(side)
+		n := len(player.Plays) - 1
+		if n >= 0 && player.Plays[n:] != NoMove && opponent.Plays[n:] != NoMove {
+			gamePlay := NewGamePlay(player.Plays, opponent.Plays)
+			gamePlay.CookieId = player.CookieId
+			gamePlay.Strategy = HumanStrategyName
+			gamePlay.RuleSet = m.RuleSetName
+			gamePlay.Opponent = opponent.CookieId
+			if err := playStore.RecordPlay(c, m.RuleSet(), gamePlay); err != nil {
+				logger.Errorf(c, "Error while storing play of match %v: %v", m.Id, err)
+			}
+			if err := eventSink.SendPlay(c, NewPlayEvent(gamePlay, player.Client)); err != nil {
+				logger.Errorf(c, "Error while sending play of match %v to the analytics: %v", m.Id, err)
+			}
+		}
+		if m.Finished {
+			if err := playStore.RecordGame(c, m.Result(side)); err != nil {
+				logger.Errorf(c, "Error while storing match %v: %v", m.Id, err)
+			}
+			if err := eventSink.SendGame(c, NewGameEvent(m.Result(side), player.Client)); err != nil {
+				logger.Errorf(c, "Error while sending match %v to the analytics: %v", m.Id, err)
+			}
+		}
+	}
+
+	// Update the ratings of both players, and the tournament of the
+	// match if any, once finished, which need Datastore
+	if m.Finished && appengine.IsAppEngine() {
+		if _, _, err := RecordRatings(c, PlayerRating, m.A.CookieId, PlayerRating, m.B.CookieId, Score(m.Result("a").Winner)); err != nil {
+			logger.Errorf(c, "Error while recording ratings of match %v: %v", m.Id, err)
+		}
+		if m.Tournament != 0 {
+			if err := RecordTournamentResult(c, m); err != nil {
+				logger.Errorf(c, "Error while recording match %v in tournament %v: %v", m.Id, m.Tournament, err)
+			}
+		}
+	}
+}
+
+// Requests of this instance waiting for an update of a key, to wake
+// them up at once when it is updated
+type Notifier struct {
+	sync.Mutex
+	channels map[string][]chan bool
+}
+
+// Waiters for updates of matches (by id) and of pairings (by cookie id)
+var (
+	matchUpdates   = &Notifier{channels: make(map[string][]chan bool)}
+	pairingUpdates = &Notifier{channels: make(map[string][]chan bool)}
+)
+
+// Wake up the requests waiting for an update of a key
+func (n *Notifier) Notify(key string) {
+	n.Lock()
+	defer n.Unlock()
+	for _, ch := range n.channels[key] {
+		close(ch)
+	}
+	delete(n.channels, key)
+}
+
+// Wait up to timeout for an update of a key
+func (n *Notifier) Wait(key string, timeout time.Duration) {
+	ch := make(chan bool)
+	n.Lock()
+	n.channels[key] = append(n.channels[key], ch)
+	n.Unlock()
+
+	select {
+	case <-ch:
+		return
+	case <-time.After(timeout):
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	channels := n.channels[key]
+	for i := range channels {
+		if channels[i] == ch {
+			n.channels[key] = append(channels[:i], channels[i+1:]...)
+			break
+		}
+	}
+	if len(n.channels[key]) == 0 {
+		delete(n.channels, key)
+	}
+}
+
+// Return the error status code for errors of the match functions
+func MatchErrorStatus(err error) int {
+	switch err {
+	case ErrorMatchNotFound:
+		return http.StatusNotFound
+	case ErrorNotInMatch:
+		return http.StatusForbidden
+	case ErrorInvalidMatchId, ErrorAlreadyPlayed:
+		return http.StatusBadRequest
+	}
+	return GameErrorStatus(err)
+}
+
+// Return the match of a request (m parameter), checking the player (ID
+// cookie) is in it, and marking the player present
+func RequestMatch(c context.Context, r *http.Request) (*Match, error) {
+	id, _ := strconv.ParseInt(r.FormValue("m"), 10, 64)
+	m, err := GetMatch(c, id)
+	if err != nil {
+		return nil, err
+	}
+	cookieId := RequestCookieId(r)
+	side := m.Side(cookieId)
+	if side == "" {
+		return nil, ErrorNotInMatch
+	}
+	if player, _ := m.Players(side); !player.Present {
+		return EnterMatch(c, id, cookieId)
+	}
+	return m, nil
+}
+
+// Answer of the matchmaking to a player: still waiting for an opponent,
+// paired with the bot, or the match to play
+type MatchmakingStatus struct {
+	Waiting bool   `json:"waiting,omitempty"`
+	Bot     bool   `json:"bot,omitempty"`
+	Match   *Match `json:"match,omitempty"`
+}
+
+// Put the player (ID cookie) in the matchmaking queue of the requested
+// game rules and rule set, and wait up to PollTimeout for an opponent
+// Return the matchmaking status in JSON in HTTP response: the player
+// should ask again while waiting, and play the bot if paired with it
+func JoinMatchHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Join Match Handler")
+
+	cookieId := RequestCookieId(r)
+	if cookieId == "" {
+		logger.Errorf(c, "Error, missing cookie ID")
+		http.Error(w, "Error: "+ErrorMissingCookie.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rules, err := RequestGameRules(r)
+	if err != nil {
+		logger.Errorf(c, "Error, invalid game rules: %v", err)
+		http.Error(w, "Error: "+err.Error(), MatchErrorStatus(err))
+		return
+	}
+
+	ruleSet, err := RequestRuleSet(r)
+	if err != nil {
+		logger.Errorf(c, "Error, invalid rule set: %v", err)
+		http.Error(w, "Error: "+err.Error(), MatchErrorStatus(err))
+		return
+	}
+
+	// Players are only rated on App Engine, and paired by wait time
+	// with the initial rating otherwise
+	rating := NewRating(PlayerRating, cookieId)
+	if appengine.IsAppEngine() {
+		if rating, err = GetRating(c, PlayerRating, cookieId); err != nil {
+			logger.Errorf(c, "Error while getting rating of player %v: %v", cookieId, err)
+		}
+	}
+
+	status := MatchmakingStatus{}
+	p, ok := WaitPairing(Ticket{
+		CookieId: cookieId,
+		Rating:   rating.Rating,
+		Queue:    MatchQueue(rules, ruleSet),
+		Client:   NewClientInfo(r),
+		Seen:     time.Now(),
+	}, PollTimeout)
+	switch {
+	case !ok:
+		status.Waiting = true
+	case p.Bot:
+		logger.Infof(c, "No opponent found for player %v, playing the bot", cookieId)
+		status.Bot = true
+	default:
+		m, err := StartMatch(c, NewMatch(p, rules, ruleSet))
+		if err != nil {
+			logger.Errorf(c, "Error while starting match %v: %v", p.Id, err)
+			http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status.Match = m.View(cookieId)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(status))
+
+}
+
+// Play the move (u parameter) of the player (ID cookie) in the current
+// round of a match (m parameter)
+// Return the match in JSON in HTTP response
+func MatchMoveHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Match Move Handler")
+
+	id, _ := strconv.ParseInt(r.FormValue("m"), 10, 64)
+	m, err := PlayMatchMove(c, id, RequestCookieId(r), r.FormValue("u"))
+	if err != nil {
+		logger.Errorf(c, "Error while playing in match %v: %v", id, err)
+		http.Error(w, "Error: "+err.Error(), MatchErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(m.View(RequestCookieId(r))))
+
+}
+
+// Long polling of a match (m parameter) for the player (ID cookie):
+// wait for a version newer than the v parameter, or for PollTimeout
+// Return the match in JSON in HTTP response
+func MatchPollHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Match Poll Handler")
+
+	m, err := RequestMatch(c, r)
+	if err != nil {
+		logger.Errorf(c, "Error while getting match: %v", err)
+		http.Error(w, "Error: "+err.Error(), MatchErrorStatus(err))
+		return
+	}
+
+	version, err := strconv.Atoi(r.FormValue("v"))
+	if err != nil {
+		version = -1
+	}
+	id := m.Id
+	if m, err = WaitMatch(c, id, version, PollTimeout); err != nil {
+		logger.Errorf(c, "Error while waiting for match %v: %v", id, err)
+		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(m.View(RequestCookieId(r))))
+
+}
+
+// Move sent by a player over a WebSocket
+type MatchMessage struct {
+	Move string `json:"move"`
+}
+
+// WebSocket of a match (m parameter) for the player (ID cookie):
+// receive the moves of the player as {"move": ...} messages, and push
+// every new version of the match in JSON until it is finished.
+// WebSockets are only available on the standalone server, not on the App
+// Engine standard environment, where clients fall back to /pvp/poll and
+// /pvp/move.
+func MatchSocketHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Match Socket Handler")
+
+	m, err := RequestMatch(c, r)
+	if err != nil {
+		logger.Errorf(c, "Error while getting match: %v", err)
+		http.Error(w, "Error: "+err.Error(), MatchErrorStatus(err))
+		return
+	}
+	id, cookieId := m.Id, RequestCookieId(r)
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		// Play the moves received until the connection closes
+		closed := make(chan bool)
+		go func() {
+			defer close(closed)
+			for {
+				var msg MatchMessage
+				if err := websocket.JSON.Receive(ws, &msg); err != nil {
+					return
+				}
+				if _, err := PlayMatchMove(c, id, cookieId, msg.Move); err != nil {
+					logger.Errorf(c, "Error while playing in match %v: %v", id, err)
+					websocket.JSON.Send(ws, map[string]string{"error": err.Error()})
+				}
+			}
+		}()
+
+		// Push the new versions of the match
+		version := -1
+		for {
+			select {
+			case <-closed:
+				return
+			default:
+			}
+			m, err := WaitMatch(c, id, version, time.Second)
+			if err != nil {
+				logger.Errorf(c, "Error while waiting for match %v: %v", id, err)
+				return
+			}
+			if m.Version > version {
+				version = m.Version
+				if err := websocket.JSON.Send(ws, m.View(cookieId)); err != nil {
+					return
+				}
+			}
+			if m.Finished {
+				return
+			}
+		}
+	}).ServeHTTP(w, r)
+
+}
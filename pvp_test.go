@@ -0,0 +1,80 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"golang.org/x/net/context"
+	"testing"
+)
+
+// Drop the events sent during the test
+func useNoEventSink(t *testing.T) {
+	saved := eventSink
+	eventSink = NoEventSink{}
+	t.Cleanup(func() {
+		eventSink = saved
+	})
+}
+
+// Play a best of 3 match won by alice against bob in the play store
+func playTestMatch(t *testing.T) {
+	c := context.Background()
+	rules, _ := GetGameRules("best-of-3")
+	p := Pairing{Id: 42, Players: []Ticket{
+		{CookieId: "alice", Client: ClientInfo{Country: "FR"}},
+		{CookieId: "bob", Client: ClientInfo{Country: "JP"}},
+	}}
+	m, err := StartMatch(c, NewMatch(p, rules, Classic))
+	if err != nil {
+		t.Fatalf("StartMatch: %v", err)
+	}
+	if again, err := StartMatch(c, NewMatch(p, rules, Classic)); err != nil || !again.CreatedTime.Equal(m.CreatedTime) {
+		t.Fatalf("StartMatch again = %+v, %v, want the stored match", again, err)
+	}
+	if _, err := GetMatch(c, 0); err != ErrorInvalidMatchId {
+		t.Errorf("GetMatch(0): %v, want %v", err, ErrorInvalidMatchId)
+	}
+	if _, err := GetMatch(c, 43); err != ErrorMatchNotFound {
+		t.Errorf("GetMatch of an unknown match: %v, want %v", err, ErrorMatchNotFound)
+	}
+	if _, err := PlayMatchMove(c, 42, "carol", "rock"); err != ErrorNotInMatch {
+		t.Errorf("PlayMatchMove of another player: %v, want %v", err, ErrorNotInMatch)
+	}
+
+	for round := 1; round <= 2; round++ {
+		m, err = PlayMatchMove(c, 42, "alice", "rock")
+		if err != nil || !m.A.Ready || m.Round != round-1 {
+			t.Fatalf("Round %v: PlayMatchMove of alice = %+v, %v, want waiting for bob", round, m, err)
+		}
+		if _, err := PlayMatchMove(c, 42, "alice", "paper"); err != ErrorAlreadyPlayed {
+			t.Errorf("Round %v: PlayMatchMove twice: %v, want %v", round, err, ErrorAlreadyPlayed)
+		}
+		if m, err = PlayMatchMove(c, 42, "bob", "scissor"); err != nil || m.Round != round || m.A.Wins != round {
+			t.Fatalf("Round %v: PlayMatchMove of bob = %+v, %v, want round won by alice", round, m, err)
+		}
+	}
+	if !m.Finished || m.Winner != "a" || m.Version != 4 {
+		t.Errorf("Match %+v, want won by a at version 4", m)
+	}
+	if _, err := PlayMatchMove(c, 42, "bob", "rock"); err != ErrorGameFinished {
+		t.Errorf("PlayMatchMove of a finished match: %v, want %v", err, ErrorGameFinished)
+	}
+
+	stored, err := GetMatch(c, 42)
+	if err != nil {
+		t.Fatalf("GetMatch: %v", err)
+	}
+	if stored.A.Plays != "rr" || stored.B.Plays != "ss" || stored.B.Client.Country != "JP" ||
+		stored.Rules != rules || stored.Version != m.Version || !stored.Deadline.Equal(m.Deadline) {
+		t.Errorf("Stored match %+v, want %+v", stored, m)
+	}
+	history, err := playStore.PlayerHistory(c, "bob", HistorySize)
+	if err != nil || len(history) != 2 || history[0].Opponent != "alice" || history[0].Strategy != HumanStrategyName {
+		t.Errorf("PlayerHistory of bob = %+v, %v, want 2 plays against alice", history, err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	useMemoryPlayStore(t)
+	useNoEventSink(t)
+	playTestMatch(t)
+}
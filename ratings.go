@@ -0,0 +1,425 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Types of rated players: human players (by cookie id) and server
+// strategies (by name), each strategy being treated as a player
+const (
+	PlayerRating   = "player"
+	StrategyRating = "strategy"
+)
+
+// Initial Glicko-2 rating of a player, its deviation and volatility, and
+// the constraint on the change of volatility over time
+const (
+	DefaultRating     = 1500
+	DefaultDeviation  = 350
+	DefaultVolatility = 0.06
+	RatingTau         = 0.5
+)
+
+// Factor converting Glicko ratings to the Glicko-2 scale
+const glicko2Scale = 173.7178
+
+// Structure to store the Glicko-2 rating of a player in Datastore. The
+// rating is on the same scale as Elo ratings, the deviation measures its
+// uncertainty (the rating is within two deviations 95% of the time).
+type Rating struct {
+	Type        string    `json:"type"`
+	Name        string    `json:"name"`
+	Rating      float64   `json:"rating"`
+	Deviation   float64   `json:"deviation"`
+	Volatility  float64   `json:"volatility" datastore:",noindex"`
+	Games       int       `json:"games"`
+	Wins        int       `json:"wins"`
+	Draws       int       `json:"draws"`
+	Losses      int       `json:"losses"`
+	UpdatedTime time.Time `json:"updated_time,omitempty"`
+}
+
+// Return the initial rating of a player
+func NewRating(ratingType, name string) Rating {
+	return Rating{
+		Type:       ratingType,
+		Name:       name,
+		Rating:     DefaultRating,
+		Deviation:  DefaultDeviation,
+		Volatility: DefaultVolatility,
+	}
+}
+
+// Return the score of a game for the user from the winner of the game:
+// 1 if the user won, 0 if the server (or opponent) won, 0.5 for a draw
+func Score(winner string) float64 {
+	switch winner {
+	case "user":
+		return 1
+	case "server":
+		return 0
+	}
+	return 0.5
+}
+
+// Return the rating updated with the score (1, 0.5 or 0) of a game
+// against an opponent, following the Glicko-2 system with each game
+// as a rating period
+func (r Rating) Update(opponent Rating, score float64) Rating {
+	return r.UpdatePeriod([]Rating{opponent}, []float64{score})
+}
+
+// Return the rating updated with the scores (1, 0.5 or 0) of the games
+// of a rating period against opponents, following the Glicko-2 system.
+// Only the deviation grows after a period without games.
+func (r Rating) UpdatePeriod(opponents []Rating, scores []float64) Rating {
+	mu := (r.Rating - DefaultRating) / glicko2Scale
+	phi := r.Deviation / glicko2Scale
+	if len(opponents) == 0 {
+		r.Deviation = glicko2Scale * math.Sqrt(phi*phi+r.Volatility*r.Volatility)
+		return r
+	}
+
+	// Estimated variance of the rating, and sum of the differences between
+	// the scores and the expected scores
+	variance, improvement := 0.0, 0.0
+	for j, opponent := range opponents {
+		muJ := (opponent.Rating - DefaultRating) / glicko2Scale
+		phiJ := opponent.Deviation / glicko2Scale
+		g := 1 / math.Sqrt(1+3*phiJ*phiJ/(math.Pi*math.Pi))
+		e := 1 / (1 + math.Exp(-g*(mu-muJ)))
+		variance += g * g * e * (1 - e)
+		improvement += g * (scores[j] - e)
+	}
+	v := 1 / variance
+	delta := v * improvement
+
+	// New volatility, by the Illinois algorithm
+	a := math.Log(r.Volatility * r.Volatility)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(RatingTau*RatingTau)
+	}
+	A, B := a, 0.0
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*RatingTau) < 0 {
+			k++
+		}
+		B = a - k*RatingTau
+	}
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > 0.000001 {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA = fA / 2
+		}
+		B, fB = C, fC
+	}
+	volatility := math.Exp(A / 2)
+
+	// New deviation and rating
+	phiStar := math.Sqrt(phi*phi + volatility*volatility)
+	newPhi := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	newMu := mu + newPhi*newPhi*improvement
+
+	r.Rating = glicko2Scale*newMu + DefaultRating
+	r.Deviation = glicko2Scale * newPhi
+	r.Volatility = volatility
+	for _, score := range scores {
+		r.Games++
+		switch score {
+		case 1:
+			r.Wins++
+		case 0:
+			r.Losses++
+		default:
+			r.Draws++
+		}
+	}
+	return r
+}
+
+// Return the Datastore key of the rating of a player
+func RatingKey(c context.Context, ratingType, name string) *datastore.Key {
+	return datastore.NewKey(c, "Rating", ratingType+":"+name, 0, nil)
+}
+
+// Return the rating of a player, the initial one if not rated yet
+func GetRating(c context.Context, ratingType, name string) (Rating, error) {
+	rating := NewRating(ratingType, name)
+	err := datastore.Get(c, RatingKey(c, ratingType, name), &rating)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return rating, err
+}
+
+// Get the ratings of these keys, keeping the initial ratings given for
+// the players not rated yet
+func getRatings(c context.Context, keys []*datastore.Key, ratings []Rating) error {
+	stored := make([]Rating, len(ratings))
+	err := datastore.GetMulti(c, keys, stored)
+	merr, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+	for i := range ratings {
+		if ok && merr[i] == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if ok && merr[i] != nil {
+			return merr[i]
+		}
+		ratings[i] = stored[i]
+	}
+	return nil
+}
+
+// Return the ratings of all registered strategies
+func GetStrategyRatings(c context.Context) ([]Rating, error) {
+	names := StrategyNames()
+	keys := make([]*datastore.Key, len(names))
+	ratings := make([]Rating, len(names))
+	for i, name := range names {
+		keys[i] = RatingKey(c, StrategyRating, name)
+		ratings[i] = NewRating(StrategyRating, name)
+	}
+	if err := getRatings(c, keys, ratings); err != nil {
+		return nil, err
+	}
+	return ratings, nil
+}
+
+// Update in a transaction the ratings of two players (of types and
+// names aType:aName and bType:bName) after a game, score being the one
+// of the first player (1, 0.5 or 0), and return their new ratings
+func RecordRatings(c context.Context, aType, aName, bType, bName string, score float64) (Rating, Rating, error) {
+	var updated []Rating
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		keys := []*datastore.Key{RatingKey(tc, aType, aName), RatingKey(tc, bType, bName)}
+		ratings := []Rating{NewRating(aType, aName), NewRating(bType, bName)}
+		if err := getRatings(tc, keys, ratings); err != nil {
+			return err
+		}
+		updated = []Rating{
+			ratings[0].Update(ratings[1], score),
+			ratings[1].Update(ratings[0], 1-score),
+		}
+		for i := range updated {
+			updated[i].UpdatedTime = time.Now()
+		}
+		_, err := datastore.PutMulti(tc, keys, updated)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return Rating{}, Rating{}, err
+	}
+	return updated[0], updated[1], nil
+}
+
+// Structure to store in Datastore a game of a player against a server
+// strategy, waiting to be counted in the rating of the strategy. Each
+// game is a root entity so the games are recorded at the same time.
+type StrategyGame struct {
+	Strategy  string    `json:"strategy"`
+	Rating    float64   `json:"rating" datastore:",noindex"`
+	Deviation float64   `json:"deviation" datastore:",noindex"`
+	Score     float64   `json:"score" datastore:",noindex"`
+	Time      time.Time `json:"time" datastore:",noindex"`
+}
+
+// Maximum number of games counted in the ratings of the strategies by a
+// transaction, each game being its own entity group along the rating,
+// and by a cron job
+const (
+	StrategyGamesBatch = 24
+	StrategyGamesLimit = 1000
+)
+
+// Update in a transaction the rating of a player after a game against a
+// server strategy, score being the one of the player (1, 0.5 or 0), and
+// return the new rating. The game is kept to be counted later in the
+// rating of the strategy, which many players update at the same time.
+func RecordStrategyGame(c context.Context, cookieId, strategy string, score float64) (Rating, error) {
+	opponent, err := GetRating(c, StrategyRating, strategy)
+	if err != nil {
+		return Rating{}, err
+	}
+	var updated Rating
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		key := RatingKey(tc, PlayerRating, cookieId)
+		rating, err := GetRating(tc, PlayerRating, cookieId)
+		if err != nil {
+			return err
+		}
+		game := StrategyGame{
+			Strategy:  strategy,
+			Rating:    rating.Rating,
+			Deviation: rating.Deviation,
+			Score:     1 - score,
+			Time:      time.Now(),
+		}
+		updated = rating.Update(opponent, score)
+		updated.UpdatedTime = time.Now()
+		if _, err := datastore.Put(tc, key, &updated); err != nil {
+			return err
+		}
+		_, err = datastore.Put(tc, datastore.NewIncompleteKey(tc, "StrategyGame", nil), &game)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	return updated, err
+}
+
+// Count the games waiting in the ratings of their strategies, by
+// batches of StrategyGamesBatch games of a strategy each being a rating
+// period, and return the number of games counted
+func UpdateStrategyRatings(c context.Context) (int, error) {
+	var games []StrategyGame
+	keys, err := datastore.NewQuery("StrategyGame").Limit(StrategyGamesLimit).GetAll(c, &games)
+	if err != nil {
+		return 0, err
+	}
+	byStrategy := make(map[string][]*datastore.Key)
+	for i, game := range games {
+		byStrategy[game.Strategy] = append(byStrategy[game.Strategy], keys[i])
+	}
+
+	counted := 0
+	for strategy, keys := range byStrategy {
+		for len(keys) > 0 {
+			n := len(keys)
+			if n > StrategyGamesBatch {
+				n = StrategyGamesBatch
+			}
+			batch, err := updateStrategyRating(c, strategy, keys[:n])
+			if err != nil {
+				return counted, err
+			}
+			counted += batch
+			keys = keys[n:]
+		}
+	}
+	return counted, nil
+}
+
+// Count games of a strategy in its rating and delete them in a
+// transaction, skipping the ones already counted, and return the number
+// of games counted
+func updateStrategyRating(c context.Context, strategy string, keys []*datastore.Key) (int, error) {
+	counted := 0
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		counted = 0
+		games := make([]StrategyGame, len(keys))
+		err := datastore.GetMulti(tc, keys, games)
+		merr, ok := err.(appengine.MultiError)
+		if err != nil && !ok {
+			return err
+		}
+		var found []*datastore.Key
+		var opponents []Rating
+		var scores []float64
+		for i, game := range games {
+			if ok && merr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			if ok && merr[i] != nil {
+				return merr[i]
+			}
+			found = append(found, keys[i])
+			opponents = append(opponents, Rating{Rating: game.Rating, Deviation: game.Deviation})
+			scores = append(scores, game.Score)
+		}
+		if len(found) == 0 {
+			return nil
+		}
+
+		rating, err := GetRating(tc, StrategyRating, strategy)
+		if err != nil {
+			return err
+		}
+		rating = rating.UpdatePeriod(opponents, scores)
+		rating.UpdatedTime = time.Now()
+		if _, err := datastore.Put(tc, RatingKey(tc, StrategyRating, strategy), &rating); err != nil {
+			return err
+		}
+		counted = len(found)
+		return datastore.DeleteMulti(tc, found)
+	}, &datastore.TransactionOptions{XG: true})
+	return counted, err
+}
+
+// Count the games of the players against the server strategies in the
+// ratings of the strategies, run by cron (cron.yaml)
+func UpdateStrategyRatingsHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Update Strategy Ratings Handler")
+
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		logger.Errorf(c, "Error, not a cron request")
+		http.Error(w, "Error, forbidden", http.StatusForbidden)
+		return
+	}
+
+	counted, err := UpdateStrategyRatings(c)
+	if err != nil {
+		logger.Errorf(c, "Error while updating ratings of strategies after %v games: %v", counted, err)
+		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Infof(c, "Counted %v games in the ratings of strategies", counted)
+	fmt.Fprint(w, counted)
+
+}
+
+// Provide the ratings of the server strategies, and of the player if
+// the id parameter is set
+// Return the ratings in JSON in HTTP response
+func RatingsHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Ratings Handler")
+
+	result := struct {
+		Player     *Rating  `json:"player,omitempty"`
+		Strategies []Rating `json:"strategies"`
+	}{}
+
+	if cookieId := r.FormValue("id"); cookieId != "" {
+		rating, err := GetRating(c, PlayerRating, cookieId)
+		if err != nil {
+			logger.Errorf(c, "Error while getting rating of player %v: %v", cookieId, err)
+			http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Player = &rating
+	}
+
+	strategies, err := GetStrategyRatings(c)
+	if err != nil {
+		logger.Errorf(c, "Error while getting ratings of strategies: %v", err)
+		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result.Strategies = strategies
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(result))
+
+}
@@ -0,0 +1,73 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Worked example of the Glicko-2 paper (Glickman, "Example of the
+// Glicko-2 system"): a player rated 1500 (deviation 200) beats a player
+// rated 1400 (30), and loses to players rated 1550 (100) and 1700 (300)
+// during a rating period, with tau = 0.5
+func TestRatingUpdatePeriod(t *testing.T) {
+	player := Rating{Rating: 1500, Deviation: 200, Volatility: 0.06}
+	opponents := []Rating{
+		{Rating: 1400, Deviation: 30},
+		{Rating: 1550, Deviation: 100},
+		{Rating: 1700, Deviation: 300},
+	}
+	updated := player.UpdatePeriod(opponents, []float64{1, 0, 0})
+
+	if math.Abs(updated.Rating-1464.06) > 0.01 {
+		t.Errorf("Rating = %.4f, want 1464.06", updated.Rating)
+	}
+	if math.Abs(updated.Deviation-151.52) > 0.01 {
+		t.Errorf("Deviation = %.4f, want 151.52", updated.Deviation)
+	}
+	if math.Abs(updated.Volatility-0.05999) > 0.00001 {
+		t.Errorf("Volatility = %.6f, want 0.05999", updated.Volatility)
+	}
+	if updated.Games != 3 || updated.Wins != 1 || updated.Losses != 2 || updated.Draws != 0 {
+		t.Errorf("Games %v (%v/%v/%v), want 3 (1/0/2)", updated.Games, updated.Wins, updated.Draws, updated.Losses)
+	}
+}
+
+func TestRatingUpdate(t *testing.T) {
+	a, b := NewRating(PlayerRating, "a"), NewRating(StrategyRating, "b")
+
+	// A single game is a rating period of one game
+	if got, want := a.Update(b, 1), a.UpdatePeriod([]Rating{b}, []float64{1}); got != want {
+		t.Errorf("Update = %+v, want %+v", got, want)
+	}
+
+	// Winning raises the rating, losing lowers it, both by the same
+	// amount between equal players, and the deviation shrinks
+	won, lost := a.Update(b, 1), b.Update(a, 0)
+	if won.Rating <= a.Rating || lost.Rating >= b.Rating {
+		t.Errorf("Ratings after a game %.2f and %.2f, from %v", won.Rating, lost.Rating, a.Rating)
+	}
+	if math.Abs((won.Rating-a.Rating)+(lost.Rating-b.Rating)) > 1e-9 {
+		t.Errorf("Ratings after a game %.2f and %.2f, want symmetric", won.Rating, lost.Rating)
+	}
+	if won.Deviation >= a.Deviation {
+		t.Errorf("Deviation after a game %.2f, want less than %v", won.Deviation, a.Deviation)
+	}
+	if drawn := a.Update(b, 0.5); math.Abs(drawn.Rating-a.Rating) > 1e-9 || drawn.Draws != 1 {
+		t.Errorf("Rating after a draw %.4f with %v draws, want %v with 1", drawn.Rating, drawn.Draws, a.Rating)
+	}
+
+	// Only the deviation grows after a period without games
+	idle := won.UpdatePeriod(nil, nil)
+	if idle.Rating != won.Rating || idle.Deviation <= won.Deviation || idle.Games != won.Games {
+		t.Errorf("Rating after an empty period %+v, from %+v", idle, won)
+	}
+}
+
+func TestScore(t *testing.T) {
+	for winner, want := range map[string]float64{"user": 1, "server": 0, "draw": 0.5, "": 0.5} {
+		if got := Score(winner); got != want {
+			t.Errorf("Score(%q) = %v, want %v", winner, got, want)
+		}
+	}
+}
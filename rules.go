@@ -0,0 +1,198 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/appengine"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Errors from the game rules functions
+var (
+	ErrorUnknownRules = errors.New("Unknown game rules")
+	ErrorInvalidRules = errors.New("Invalid game rules, the game could never end")
+)
+
+// Name of the game rules used when none is requested
+const DefaultRulesName = "classic"
+
+// Rules deciding when a game ends and who wins it. A game ends when a
+// player leads by at least WinBy wins (1 if 0) and either reached
+// FirstTo wins, won the majority of BestOf rounds, or at least MinRounds
+// or BestOf rounds were played. A game also ends after MaxRounds
+// rounds, as a draw if nobody leads. Draws count as rounds only if
+// DrawsCount is set.
+type GameRules struct {
+	Name       string `json:"name"`
+	Label      string `json:"label"`
+	BestOf     int    `json:"best_of,omitempty"`
+	FirstTo    int    `json:"first_to,omitempty"`
+	WinBy      int    `json:"win_by,omitempty"`
+	MinRounds  int    `json:"min_rounds,omitempty"`
+	MaxRounds  int    `json:"max_rounds,omitempty"`
+	DrawsCount bool   `json:"draws_count"`
+}
+
+// Predefined game rules
+var gameRules = []GameRules{
+	{Name: "classic", Label: "At least 7 rounds, no tie", MinRounds: 7, DrawsCount: true},
+	{Name: "best-of-3", Label: "Best of 3", BestOf: 3},
+	{Name: "best-of-5", Label: "Best of 5", BestOf: 5},
+	{Name: "best-of-7", Label: "Best of 7", BestOf: 7},
+	{Name: "first-to-5", Label: "First to 5 wins", FirstTo: 5},
+	{Name: "win-by-two", Label: "First to 3 wins, win by two", FirstTo: 3, WinBy: 2, MaxRounds: 25},
+}
+
+// Return the predefined game rules named name
+func GetGameRules(name string) (GameRules, error) {
+	for _, rules := range gameRules {
+		if rules.Name == name {
+			return rules, nil
+		}
+	}
+	return GameRules{}, ErrorUnknownRules
+}
+
+// Return the name of the game rules set in the RULES environment
+// variable (set in app.yaml), or the default ones
+func ConfiguredRulesName() string {
+	if name := os.Getenv("RULES"); name != "" {
+		return name
+	}
+	return DefaultRulesName
+}
+
+// Return the game rules of a request: the predefined rules of the
+// "rules" parameter or the configured ones, modified by the best_of,
+// first_to, win_by, min_rounds, max_rounds and draws_count parameters
+// if any
+func RequestGameRules(r *http.Request) (GameRules, error) {
+	name := r.FormValue("rules")
+	if name == "" {
+		name = ConfiguredRulesName()
+	}
+	rules, err := GetGameRules(name)
+	if err != nil {
+		return rules, err
+	}
+
+	// Custom rules from parameters
+	custom := false
+	for param, value := range map[string]*int{
+		"best_of":    &rules.BestOf,
+		"first_to":   &rules.FirstTo,
+		"win_by":     &rules.WinBy,
+		"min_rounds": &rules.MinRounds,
+		"max_rounds": &rules.MaxRounds,
+	} {
+		if r.FormValue(param) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(r.FormValue(param))
+		if err != nil || n < 0 {
+			return rules, ErrorInvalidRules
+		}
+		*value = n
+		custom = true
+	}
+	if r.FormValue("draws_count") != "" {
+		rules.DrawsCount = r.FormValue("draws_count") == "1" || r.FormValue("draws_count") == "true"
+		custom = true
+	}
+	if custom {
+		rules.Name = "custom"
+		rules.Label = rules.Describe()
+	}
+
+	if rules.BestOf == 0 && rules.FirstTo == 0 && rules.MinRounds == 0 && rules.MaxRounds == 0 {
+		return rules, ErrorInvalidRules
+	}
+	return rules, nil
+}
+
+// Return a short description of the rules, e.g. "Best of 5, win by 2"
+func (g GameRules) Describe() string {
+	text := ""
+	add := func(format string, a ...interface{}) {
+		if text != "" {
+			text += ", "
+		}
+		text += fmt.Sprintf(format, a...)
+	}
+	if g.BestOf > 0 {
+		add("Best of %v", g.BestOf)
+	}
+	if g.FirstTo > 0 {
+		add("First to %v wins", g.FirstTo)
+	}
+	if g.MinRounds > 0 {
+		add("At least %v rounds", g.MinRounds)
+	}
+	if g.WinBy > 1 {
+		add("win by %v", g.WinBy)
+	}
+	if g.MaxRounds > 0 {
+		add("at most %v rounds", g.MaxRounds)
+	}
+	if g.DrawsCount {
+		add("draws count as rounds")
+	}
+	return text
+}
+
+// Return true and the winner ("user", "server" or "draw") if a game
+// with these scores is finished
+func (g GameRules) Finished(userWins, serverWins, draws int) (bool, string) {
+	rounds := userWins + serverWins
+	if g.DrawsCount {
+		rounds += draws
+	}
+	lead, leader := userWins-serverWins, "user"
+	if lead < 0 {
+		lead, leader = -lead, "server"
+	}
+	most := userWins
+	if serverWins > most {
+		most = serverWins
+	}
+	winBy := g.WinBy
+	if winBy < 1 {
+		winBy = 1
+	}
+
+	// Game over after the maximum number of rounds, whoever leads
+	if g.MaxRounds > 0 && rounds >= g.MaxRounds {
+		if lead == 0 {
+			return true, "draw"
+		}
+		return true, leader
+	}
+
+	if lead < winBy {
+		return false, ""
+	}
+	switch {
+	case g.FirstTo > 0 && most >= g.FirstTo,
+		g.BestOf > 0 && most > g.BestOf/2,
+		g.BestOf > 0 && rounds >= g.BestOf,
+		g.MinRounds > 0 && rounds >= g.MinRounds:
+		return true, leader
+	}
+	return false, ""
+}
+
+// Provide the predefined game rules
+// Return the rules in JSON in HTTP response
+func RulesHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Rules Handler")
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(gameRules))
+
+}
@@ -0,0 +1,75 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"testing"
+)
+
+func TestGameRulesFinished(t *testing.T) {
+	custom := GameRules{Name: "custom", FirstTo: 3, WinBy: 2, MaxRounds: 6, DrawsCount: true}
+	tests := []struct {
+		rules                       string
+		userWins, serverWins, draws int
+		finished                    bool
+		winner                      string
+	}{
+		// At least 7 rounds counting draws, no tie
+		{"classic", 3, 2, 1, false, ""},
+		{"classic", 4, 2, 1, true, "user"},
+		{"classic", 2, 5, 0, true, "server"},
+		{"classic", 3, 3, 1, false, ""},
+		{"classic", 4, 3, 3, true, "user"},
+
+		// Majority of the rounds, draws not counted
+		{"best-of-3", 1, 1, 0, false, ""},
+		{"best-of-3", 1, 1, 5, false, ""},
+		{"best-of-3", 2, 0, 0, true, "user"},
+		{"best-of-3", 1, 2, 0, true, "server"},
+		{"best-of-5", 2, 2, 0, false, ""},
+		{"best-of-5", 3, 1, 0, true, "user"},
+		{"best-of-7", 3, 3, 0, false, ""},
+		{"best-of-7", 3, 4, 0, true, "server"},
+
+		// First to a number of wins
+		{"first-to-5", 4, 0, 10, false, ""},
+		{"first-to-5", 5, 4, 0, true, "user"},
+		{"first-to-5", 4, 5, 0, true, "server"},
+
+		// First to 3, by two wins, at most 25 rounds
+		{"win-by-two", 3, 2, 0, false, ""},
+		{"win-by-two", 4, 2, 0, true, "user"},
+		{"win-by-two", 10, 12, 0, true, "server"},
+		{"win-by-two", 12, 12, 0, false, ""},
+		{"win-by-two", 13, 12, 0, true, "user"},
+	}
+	for _, test := range tests {
+		rules, err := GetGameRules(test.rules)
+		if err != nil {
+			t.Fatalf("GetGameRules(%v): %v", test.rules, err)
+		}
+		finished, winner := rules.Finished(test.userWins, test.serverWins, test.draws)
+		if finished != test.finished || winner != test.winner {
+			t.Errorf("%v.Finished(%v, %v, %v) = %v, %q, want %v, %q", test.rules, test.userWins, test.serverWins, test.draws, finished, winner, test.finished, test.winner)
+		}
+	}
+
+	// A game reaching the maximum number of rounds without a leader is a
+	// draw
+	if finished, winner := custom.Finished(2, 2, 2); !finished || winner != "draw" {
+		t.Errorf("%v.Finished(2, 2, 2) = %v, %q, want true, \"draw\"", custom.Name, finished, winner)
+	}
+	if finished, winner := custom.Finished(2, 1, 2); finished {
+		t.Errorf("%v.Finished(2, 1, 2) = %v, %q, want false", custom.Name, finished, winner)
+	}
+}
+
+func TestGetGameRules(t *testing.T) {
+	if _, err := GetGameRules("best-of-4"); err != ErrorUnknownRules {
+		t.Errorf("GetGameRules(best-of-4): %v, want %v", err, ErrorUnknownRules)
+	}
+	for _, rules := range gameRules {
+		if got, err := GetGameRules(rules.Name); err != nil || got != rules {
+			t.Errorf("GetGameRules(%v) = %v, %v", rules.Name, got, err)
+		}
+	}
+}
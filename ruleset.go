@@ -0,0 +1,172 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Errors from the rule set functions
+var (
+	ErrorUnknownRuleSet = errors.New("Unknown rule set")
+	ErrorInvalidRuleSet = errors.New("Invalid rule set")
+)
+
+// Name of the rule set used when none is requested
+const DefaultRuleSetName = "classic"
+
+// Set of moves of a game, with their one letter short codes used to
+// store plays (e.g. "rps" for rock, paper, scissor). Moves are listed
+// in a cyclic order where each move beats the (N-1)/2 moves before it,
+// so every move beats as many moves as it loses to (N must be odd).
+type RuleSet struct {
+	Name  string   `json:"name"`
+	Label string   `json:"label"`
+	Moves []string `json:"moves"`
+	Codes []string `json:"codes"`
+}
+
+// Classic Rock Paper Scissors
+var Classic = &RuleSet{
+	Name:  "classic",
+	Label: "Rock Paper Scissors",
+	Moves: []string{"rock", "paper", "scissor"},
+	Codes: []string{"r", "p", "s"},
+}
+
+// Available rule sets
+var ruleSets = []*RuleSet{
+	Classic,
+	{
+		Name:  "rpsls",
+		Label: "Rock Paper Scissors Lizard Spock",
+		Moves: []string{"rock", "spock", "paper", "lizard", "scissor"},
+		Codes: []string{"r", "k", "p", "l", "s"},
+	},
+	{
+		Name:  "rps7",
+		Label: "Rock Paper Scissors 7",
+		Moves: []string{"water", "air", "paper", "sponge", "scissor", "fire", "rock"},
+		Codes: []string{"w", "a", "p", "g", "s", "f", "r"},
+	},
+}
+
+// Check all rule sets are valid when starting
+func init() {
+	for _, rs := range ruleSets {
+		if err := rs.Validate(); err != nil {
+			panic(fmt.Sprintf("Rule set %v: %v", rs.Name, err))
+		}
+	}
+}
+
+// Return the rule set named name, the classic one if name is ""
+func GetRuleSet(name string) (*RuleSet, error) {
+	if name == "" {
+		return Classic, nil
+	}
+	for _, rs := range ruleSets {
+		if rs.Name == name {
+			return rs, nil
+		}
+	}
+	return nil, ErrorUnknownRuleSet
+}
+
+// Return the name of the rule set set in the RULE_SET environment
+// variable (set in app.yaml), or the default one
+func ConfiguredRuleSetName() string {
+	if name := os.Getenv("RULE_SET"); name != "" {
+		return name
+	}
+	return DefaultRuleSetName
+}
+
+// Return the rule set of the "ruleset" parameter of a request, or the
+// configured one
+func RequestRuleSet(r *http.Request) (*RuleSet, error) {
+	name := r.FormValue("ruleset")
+	if name == "" {
+		name = ConfiguredRuleSetName()
+	}
+	return GetRuleSet(name)
+}
+
+// Check the rule set has an odd number of moves with distinct one
+// letter codes
+func (rs *RuleSet) Validate() error {
+	if len(rs.Moves) < 3 || len(rs.Moves)%2 == 0 || len(rs.Codes) != len(rs.Moves) {
+		return ErrorInvalidRuleSet
+	}
+	seen := make(map[string]bool)
+	for _, code := range rs.Codes {
+		if len(code) != 1 || seen[code] {
+			return ErrorInvalidRuleSet
+		}
+		seen[code] = true
+	}
+	return nil
+}
+
+// Return the index of a move code, or -1 if unknown
+func (rs *RuleSet) Index(code string) int {
+	for i, c := range rs.Codes {
+		if c == code {
+			return i
+		}
+	}
+	return -1
+}
+
+// Return the code of a move, or "" if unknown
+func (rs *RuleSet) Code(move string) string {
+	for i, m := range rs.Moves {
+		if m == move {
+			return rs.Codes[i]
+		}
+	}
+	return ""
+}
+
+// Return the move of a code, or "" if unknown
+func (rs *RuleSet) Move(code string) string {
+	if i := rs.Index(code); i >= 0 {
+		return rs.Moves[i]
+	}
+	return ""
+}
+
+// Compress a set of plays by their codes.
+// For example "rock paper rock" will return "rpr"
+func (rs *RuleSet) Compress(text string) string {
+	result := ""
+	for _, w := range strings.Split(text, " ") {
+		result += rs.Code(w)
+	}
+	return result
+}
+
+// Return true if move code a beats move code b
+func (rs *RuleSet) Beats(a, b string) bool {
+	i, j := rs.Index(a), rs.Index(b)
+	if i < 0 || j < 0 {
+		return false
+	}
+	n := len(rs.Codes)
+	d := (i - j + n) % n
+	return d >= 1 && d <= (n-1)/2
+}
+
+// Return the move beating a move code, the one right after it in the
+// cyclic order (i.e. paper for "r" in the classic game). Return "" if
+// the code is unknown.
+func (rs *RuleSet) Counter(code string) string {
+	i := rs.Index(code)
+	if i < 0 {
+		return ""
+	}
+	return rs.Moves[(i+1)%len(rs.Moves)]
+}
@@ -0,0 +1,98 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"testing"
+)
+
+// Return the rule set named name, failing the test if unknown
+func testRuleSet(t *testing.T, name string) *RuleSet {
+	rs, err := GetRuleSet(name)
+	if err != nil {
+		t.Fatalf("GetRuleSet(%v): %v", name, err)
+	}
+	return rs
+}
+
+// Check the winning pairs of moves (winner first) of a rule set, and
+// that every move beats as many moves as it loses to
+func checkBeats(t *testing.T, rs *RuleSet, wins [][2]string) {
+	beats := make(map[[2]string]bool)
+	for _, w := range wins {
+		beats[[2]string{rs.Code(w[0]), rs.Code(w[1])}] = true
+	}
+	if len(beats) != len(rs.Moves)*(len(rs.Moves)-1)/2 {
+		t.Fatalf("%v: %v winning pairs, want %v", rs.Name, len(beats), len(rs.Moves)*(len(rs.Moves)-1)/2)
+	}
+	for _, a := range rs.Codes {
+		n := 0
+		for _, b := range rs.Codes {
+			want := beats[[2]string{a, b}]
+			if got := rs.Beats(a, b); got != want {
+				t.Errorf("%v: Beats(%v, %v) = %v, want %v", rs.Name, rs.Move(a), rs.Move(b), got, want)
+			}
+			if rs.Beats(a, b) {
+				n++
+			}
+		}
+		if n != (len(rs.Codes)-1)/2 {
+			t.Errorf("%v: %v beats %v moves, want %v", rs.Name, rs.Move(a), n, (len(rs.Codes)-1)/2)
+		}
+		if counter := rs.Code(rs.Counter(a)); !rs.Beats(counter, a) {
+			t.Errorf("%v: Counter(%v) = %v does not beat it", rs.Name, rs.Move(a), rs.Move(counter))
+		}
+	}
+}
+
+func TestBeatsClassic(t *testing.T) {
+	checkBeats(t, testRuleSet(t, "classic"), [][2]string{
+		{"rock", "scissor"},
+		{"paper", "rock"},
+		{"scissor", "paper"},
+	})
+}
+
+func TestBeatsRPSLS(t *testing.T) {
+	checkBeats(t, testRuleSet(t, "rpsls"), [][2]string{
+		{"scissor", "paper"},
+		{"paper", "rock"},
+		{"rock", "lizard"},
+		{"lizard", "spock"},
+		{"spock", "scissor"},
+		{"scissor", "lizard"},
+		{"lizard", "paper"},
+		{"paper", "spock"},
+		{"spock", "rock"},
+		{"rock", "scissor"},
+	})
+}
+
+func TestBeatsRPS7(t *testing.T) {
+	checkBeats(t, testRuleSet(t, "rps7"), [][2]string{
+		{"rock", "fire"}, {"rock", "scissor"}, {"rock", "sponge"},
+		{"fire", "scissor"}, {"fire", "sponge"}, {"fire", "paper"},
+		{"scissor", "sponge"}, {"scissor", "paper"}, {"scissor", "air"},
+		{"sponge", "paper"}, {"sponge", "air"}, {"sponge", "water"},
+		{"paper", "air"}, {"paper", "water"}, {"paper", "rock"},
+		{"air", "water"}, {"air", "rock"}, {"air", "fire"},
+		{"water", "rock"}, {"water", "fire"}, {"water", "scissor"},
+	})
+}
+
+func TestBeatsUnknownMove(t *testing.T) {
+	if Classic.Beats("r", "x") || Classic.Beats("x", "r") || Classic.Beats("", "") {
+		t.Errorf("Beats with an unknown move code, want false")
+	}
+}
+
+func TestRuleSetsValid(t *testing.T) {
+	for _, rs := range ruleSets {
+		if err := rs.Validate(); err != nil {
+			t.Errorf("%v: %v", rs.Name, err)
+		}
+	}
+	invalid := &RuleSet{Name: "even", Moves: []string{"a", "b", "c", "d"}, Codes: []string{"a", "b", "c", "d"}}
+	if err := invalid.Validate(); err != ErrorInvalidRuleSet {
+		t.Errorf("Validate of 4 moves: %v, want %v", err, ErrorInvalidRuleSet)
+	}
+}
@@ -0,0 +1,223 @@
+// Rock Paper Scissors Game on App Engine
+
+//go:build !appengine && !arena && !backtest
+// +build !appengine,!arena,!backtest
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Errors from the configuration of the server
+var (
+	ErrorUnknownStore     = errors.New("Unknown store")
+	ErrorUnknownAnalytics = errors.New("Unknown analytics sink")
+)
+
+// Configuration of the standalone server, read from a JSON file whose
+// values are overridden by the flags set
+type ServerConfig struct {
+	// Address to listen on, ignored on App Engine which sets the port
+	Addr string `json:"addr"`
+	// Storage of the plays, game sessions and games: memory, sqlite or
+	// datastore
+	Store string `json:"store"`
+	// Database file of the sqlite store
+	Database string `json:"database"`
+	// Sink of the plays and games for analytics: none, bigquery or jsonl
+	Analytics string `json:"analytics"`
+	// Newline delimited JSON file of the jsonl sink
+	EventsFile string `json:"events_file"`
+}
+
+// Identity of the application outside App Engine, so the App Engine
+// packages find it in the environment instead of asking the metadata
+// server. Features still using Datastore (ratings, leaderboards,
+// matches, tournaments) answer 501 Not Implemented instead.
+var localAppEngineEnv = map[string]string{
+	"GAE_APPLICATION":    "local",
+	"GAE_MODULE_VERSION": "local",
+	"GAE_MINOR_VERSION":  "1",
+}
+
+// Static files served by App Engine from app.yaml, served by the server
+// otherwise
+var staticFiles = []string{"favicon.ico", "app.js", "app.css"}
+
+// Return the default configuration: Datastore and BigQuery on App
+// Engine, and plays in memory without analytics on port $PORT or 8080
+// otherwise
+func DefaultServerConfig() ServerConfig {
+	config := ServerConfig{Addr: ":8080", Store: "memory", Database: "rps.db", Analytics: "none", EventsFile: "events.jsonl"}
+	if port := os.Getenv("PORT"); port != "" {
+		config.Addr = ":" + port
+	}
+	if appengine.IsAppEngine() {
+		config.Store = "datastore"
+		config.Analytics = "bigquery"
+	}
+	return config
+}
+
+// Read the values of a JSON configuration file, like
+//
+//	{"addr": ":8080", "store": "sqlite", "database": "rps.db", "analytics": "jsonl", "events_file": "events.jsonl"}
+func (config *ServerConfig) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return nil
+}
+
+// Open the play store of the configuration
+func (config ServerConfig) OpenPlayStore() (PlayStore, error) {
+	switch config.Store {
+	case "memory":
+		return NewMemoryPlayStore(), nil
+	case "sqlite":
+		return OpenSQLitePlayStore(config.Database)
+	case "datastore":
+		if !appengine.IsAppEngine() {
+			return nil, fmt.Errorf("%v: %v", config.Store, ErrorNotOnAppEngine)
+		}
+		return DatastorePlayStore{}, nil
+	}
+	return nil, fmt.Errorf("%v %v", ErrorUnknownStore, config.Store)
+}
+
+// Open the analytics sink of the configuration, sending the events in
+// batches out of the requests
+func (config ServerConfig) OpenEventSink() (EventSink, error) {
+	switch config.Analytics {
+	case "none":
+		return NoEventSink{}, nil
+	case "bigquery":
+		if !appengine.IsAppEngine() {
+			return nil, fmt.Errorf("%v: %v", config.Analytics, ErrorNotOnAppEngine)
+		}
+		sink := BigQuerySink{ProjectId: os.Getenv("GOOGLE_CLOUD_PROJECT"), Dataset: BigQueryDataset}
+		return NewAsyncEventSink(appengine.BackgroundContext(), sink, EventBatchSize, EventBatchAge), nil
+	case "jsonl":
+		sink, err := OpenJSONLSink(config.EventsFile)
+		if err != nil {
+			return nil, err
+		}
+		return NewAsyncEventSink(context.Background(), sink, EventBatchSize, EventBatchAge), nil
+	}
+	return nil, fmt.Errorf("%v %v", ErrorUnknownAnalytics, config.Analytics)
+}
+
+// Server of the game, as an App Engine app on the second generation
+// runtimes, or standalone anywhere else, run from the directory of
+// index.html:
+//
+//	go run . -store sqlite -db rps.db -addr :8080
+//
+// The first generation runtime (go1) builds the app with the appengine
+// tag, without this function, and registers the handlers of main.go.
+func main() {
+	config := DefaultServerConfig()
+	configPath := flag.String("config", "", "JSON configuration file, its values overridden by the flags set")
+	addr := flag.String("addr", config.Addr, "address to listen on")
+	store := flag.String("store", config.Store, "storage of the plays and games: memory, sqlite or datastore")
+	database := flag.String("db", config.Database, "database file of the sqlite store")
+	analytics := flag.String("analytics", config.Analytics, "analytics sink: none, bigquery or jsonl")
+	eventsFile := flag.String("events", config.EventsFile, "newline delimited JSON file of the jsonl sink")
+	flag.Parse()
+	if *configPath != "" {
+		if err := config.Load(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			config.Addr = *addr
+		case "store":
+			config.Store = *store
+		case "db":
+			config.Database = *database
+		case "analytics":
+			config.Analytics = *analytics
+		case "events":
+			config.EventsFile = *eventsFile
+		}
+	})
+
+	if !appengine.IsAppEngine() {
+		for name, value := range localAppEngineEnv {
+			if os.Getenv(name) == "" {
+				os.Setenv(name, value)
+			}
+		}
+	}
+	s, err := config.OpenPlayStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if closer, ok := s.(io.Closer); ok {
+		defer closer.Close()
+	}
+	playStore = s
+	sink, err := config.OpenEventSink()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if closer, ok := sink.(io.Closer); ok {
+		defer closer.Close()
+	}
+	eventSink = sink
+	for _, name := range staticFiles {
+		name := name
+		http.HandleFunc("/"+name, func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, name)
+		})
+	}
+
+	if appengine.IsAppEngine() {
+		appengine.Main()
+		return
+	}
+
+	// Serve until interrupted, then let the requests in progress finish
+	// before closing the store and the analytics sink
+	server := &http.Server{Addr: config.Addr}
+	done := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(c)
+		close(done)
+	}()
+	logger.Infof(context.Background(), "Listening on %v, %v store, %v analytics", config.Addr, config.Store, config.Analytics)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	<-done
+}
@@ -0,0 +1,272 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// Errors from the game session functions
+var (
+	ErrorGameFinished  = errors.New("Game is already finished")
+	ErrorNoServerPlay  = errors.New("No server play requested for this round")
+	ErrorUnknownPlay   = errors.New("Unknown play")
+	ErrorGameNotFound  = errors.New("Game not found")
+	ErrorInvalidGameId = errors.New("Invalid game id")
+	ErrorNotYourGame   = errors.New("Game of another player")
+)
+
+// Structure to store a game session in the play store. The server is the
+// only one to update it: it decides its play of the next round before
+// the user plays, and commits to it by sharing the hash of the play and
+// a secret nonce. Once the user played, it records the round and the
+// winner of the game, and reveals its play and nonce.
+type GameSession struct {
+	Id           int64     `json:"id" datastore:"-"`
+	CookieId     string    `json:"cookie_id,omitempty"`
+	Level        string    `json:"level,omitempty"`
+	Strategy     string    `json:"strategy,omitempty"`
+	Rules        GameRules `json:"rules"`
+	RuleSetName  string    `json:"rule_set" datastore:"RuleSet"`
+	UserPlays    string    `json:"user_plays"`
+	ServerPlays  string    `json:"server_plays"`
+	UserWins     int       `json:"user_wins"`
+	ServerWins   int       `json:"server_wins"`
+	Draws        int       `json:"draws"`
+	LastWinner   string    `json:"last_winner,omitempty"`
+	Winner       string    `json:"winner,omitempty"`
+	Finished     bool      `json:"finished"`
+	NextDecision string    `json:"-" datastore:",noindex"`
+	NextNonce    string    `json:"-" datastore:",noindex"`
+	Commitment   string    `json:"commitment,omitempty" datastore:",noindex"`
+	// Strategy deciding each server play, the arms of a bandit
+	RoundStrategies []string  `json:"-" datastore:",noindex"`
+	Reveal          *Reveal   `json:"reveal,omitempty" datastore:"-"`
+	CreatedTime     time.Time `json:"created_time"`
+	UpdatedTime     time.Time `json:"updated_time"`
+}
+
+// Server play of the last round revealed with its nonce, so the user
+// can check it matches the commitment received before playing
+type Reveal struct {
+	Play       string   `json:"play"`
+	Nonce      string   `json:"nonce"`
+	Commitment string   `json:"commitment"`
+	Decision   Decision `json:"decision"`
+}
+
+// Return the commitment to a play: the hexadecimal SHA-256 hash of
+// "play:nonce"
+func Commit(play, nonce string) string {
+	h := sha256.Sum256([]byte(play + ":" + nonce))
+	return hex.EncodeToString(h[:])
+}
+
+// Return a random nonce of 128 bits in hexadecimal
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+// Return the rule set of the game, the classic one if unknown
+func (s *GameSession) RuleSet() *RuleSet {
+	rs, err := GetRuleSet(s.RuleSetName)
+	if err != nil {
+		return Classic
+	}
+	return rs
+}
+
+// Return the round to be played next in the game
+func (s *GameSession) Round() Round {
+	return Round{
+		RuleSet:     s.RuleSet(),
+		CookieId:    s.CookieId,
+		UserPlays:   s.UserPlays,
+		ServerPlays: s.ServerPlays,
+	}
+}
+
+// Return the result of the finished game
+func (s *GameSession) Result() GameResult {
+	return GameResult{
+		CookieId:    s.CookieId,
+		RuleSet:     s.RuleSetName,
+		UserPlays:   s.UserPlays,
+		ServerPlays: s.ServerPlays,
+		Strategy:    s.PlayedStrategy(),
+		Winner:      s.Winner,
+		Time:        s.UpdatedTime,
+	}
+}
+
+// Return the strategy which decided the most server plays of the game,
+// the latest one of those deciding as many, and the strategy of the
+// game if it decided none
+func (s *GameSession) PlayedStrategy() string {
+	counts := make(map[string]int)
+	played := s.Strategy
+	for _, strategy := range s.RoundStrategies {
+		counts[strategy]++
+		if counts[strategy] >= counts[played] {
+			played = strategy
+		}
+	}
+	return played
+}
+
+// Record a round of move codes in the game, and finish the game once it
+// is over according to its rules
+func (s *GameSession) Play(userPlay, serverPlay string) {
+	rs := s.RuleSet()
+	s.UserPlays += userPlay
+	s.ServerPlays += serverPlay
+	switch {
+	case rs.Beats(userPlay, serverPlay):
+		s.UserWins++
+		s.LastWinner = "user"
+	case rs.Beats(serverPlay, userPlay):
+		s.ServerWins++
+		s.LastWinner = "server"
+	default:
+		s.Draws++
+		s.LastWinner = "deuce"
+	}
+	s.Finished, s.Winner = s.Rules.Finished(s.UserWins, s.ServerWins, s.Draws)
+}
+
+// Create and store a new game session for a player
+func NewGameSession(c context.Context, cookieId, level, strategy string, rules GameRules, ruleSet *RuleSet) (*GameSession, error) {
+	s := &GameSession{
+		CookieId:    cookieId,
+		Level:       level,
+		Strategy:    strategy,
+		Rules:       rules,
+		RuleSetName: ruleSet.Name,
+		CreatedTime: time.Now(),
+		UpdatedTime: time.Now(),
+	}
+	if err := playStore.NewSession(c, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Return the game session with this id
+func GetGameSession(c context.Context, id int64) (*GameSession, error) {
+	if id <= 0 {
+		return nil, ErrorInvalidGameId
+	}
+	s, err := playStore.GetSession(c, id)
+	if err != nil {
+		return nil, err
+	}
+	s.upgrade()
+	return s, nil
+}
+
+// Set the fields of a game session stored by an older version: games
+// started before game rules existed follow the default ones, and the
+// ones started before strategies were kept in the session play the
+// strategy of their difficulty level
+func (s *GameSession) upgrade() {
+	if s.Rules.Name == "" {
+		s.Rules, _ = GetGameRules(DefaultRulesName)
+	}
+	if d, ok := GetDifficulty(s.Level); ok && s.Strategy == "" {
+		s.Strategy = d.Strategy
+	}
+}
+
+// Update the game session with this id in a transaction
+func UpdateGameSession(c context.Context, id int64, update func(s *GameSession) error) (*GameSession, error) {
+	if id <= 0 {
+		return nil, ErrorInvalidGameId
+	}
+	return playStore.UpdateSession(c, id, func(s *GameSession) error {
+		s.upgrade()
+		if err := update(s); err != nil {
+			return err
+		}
+		s.UpdatedTime = time.Now()
+		return nil
+	})
+}
+
+// Return the commitment to the server play for the next round of a
+// game session. The play is decided by decide the first time, then kept
+// in the session until the user plays so it can't change. Only the
+// player of the game (cookieId) can ask for it.
+func NextSessionPlay(c context.Context, id int64, cookieId string, decide func(s *GameSession) Decision) (string, error) {
+	session, err := UpdateGameSession(c, id, func(s *GameSession) error {
+		if s.CookieId != cookieId {
+			return ErrorNotYourGame
+		}
+		if s.Finished {
+			return ErrorGameFinished
+		}
+		if s.NextDecision != "" {
+			return nil
+		}
+		nonce, err := NewNonce()
+		if err != nil {
+			return err
+		}
+		decision := decide(s)
+		s.NextDecision = ToJSON(decision)
+		s.NextNonce = nonce
+		s.Commitment = Commit(decision.Play, nonce)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return session.Commitment, nil
+}
+
+// Play the user move against the server decision for the round, and
+// return the updated game session with that decision revealed. Only the
+// player of the game (cookieId) can play it.
+func PlaySessionRound(c context.Context, id int64, cookieId string, userMove string) (*GameSession, Decision, error) {
+	var decision Decision
+	session, err := UpdateGameSession(c, id, func(s *GameSession) error {
+		if s.CookieId != cookieId {
+			return ErrorNotYourGame
+		}
+		userPlay := s.RuleSet().Code(userMove)
+		if userPlay == "" {
+			return ErrorUnknownPlay
+		}
+		if s.Finished {
+			return ErrorGameFinished
+		}
+		if s.NextDecision == "" {
+			return ErrorNoServerPlay
+		}
+		if err := json.Unmarshal([]byte(s.NextDecision), &decision); err != nil {
+			return err
+		}
+		s.Play(userPlay, s.RuleSet().Code(decision.Play))
+		s.RoundStrategies = append(s.RoundStrategies, decision.Strategy)
+		s.Reveal = &Reveal{
+			Play:       decision.Play,
+			Nonce:      s.NextNonce,
+			Commitment: s.Commitment,
+			Decision:   decision,
+		}
+		s.NextDecision = ""
+		s.NextNonce = ""
+		s.Commitment = ""
+		return nil
+	})
+	return session, decision, err
+}
@@ -0,0 +1,143 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"encoding/json"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Use an empty play store in memory for the test
+func useMemoryPlayStore(t *testing.T) *MemoryPlayStore {
+	store := NewMemoryPlayStore()
+	saved := playStore
+	playStore = store
+	t.Cleanup(func() {
+		playStore = saved
+	})
+	return store
+}
+
+func TestPlaySession(t *testing.T) {
+	useMemoryPlayStore(t)
+	c := context.Background()
+	rules, _ := GetGameRules("best-of-3")
+	session, err := NewGameSession(c, "player", "", "frequency", rules, Classic)
+	if err != nil {
+		t.Fatalf("NewGameSession: %v", err)
+	}
+
+	// The server always plays rock, and the user paper until the game
+	// is over
+	for round := 1; !session.Finished; round++ {
+		commitment, err := NextSessionPlay(c, session.Id, "player", func(s *GameSession) Decision {
+			return Decision{Play: "rock", Strategy: "always-rock"}
+		})
+		if err != nil {
+			t.Fatalf("Round %v: NextSessionPlay: %v", round, err)
+		}
+		again, err := NextSessionPlay(c, session.Id, "player", func(s *GameSession) Decision {
+			return Decision{Play: "paper"}
+		})
+		if err != nil || again != commitment {
+			t.Fatalf("Round %v: commitment changed from %v to %v (%v)", round, commitment, again, err)
+		}
+
+		var decision Decision
+		session, decision, err = PlaySessionRound(c, session.Id, "player", "paper")
+		if err != nil {
+			t.Fatalf("Round %v: PlaySessionRound: %v", round, err)
+		}
+		if decision.Play != "rock" || session.Reveal == nil || Commit(session.Reveal.Play, session.Reveal.Nonce) != commitment {
+			t.Fatalf("Round %v: reveal %+v does not match commitment %v", round, session.Reveal, commitment)
+		}
+	}
+	if session.UserPlays != "pp" || session.ServerPlays != "rr" || session.Winner != "user" {
+		t.Errorf("Game %v against %v won by %v, want pp against rr won by user", session.UserPlays, session.ServerPlays, session.Winner)
+	}
+	if result := session.Result(); result.Strategy != "always-rock" || result.Winner != "user" {
+		t.Errorf("Result %+v, want won by user against always-rock", result)
+	}
+
+	// The game is over, and stored without the reveal
+	if _, _, err := PlaySessionRound(c, session.Id, "player", "paper"); err != ErrorGameFinished {
+		t.Errorf("PlaySessionRound of a finished game: %v, want %v", err, ErrorGameFinished)
+	}
+	stored, err := GetGameSession(c, session.Id)
+	if err != nil || stored.Reveal != nil || !stored.Finished {
+		t.Errorf("GetGameSession = %+v, %v, want finished without reveal", stored, err)
+	}
+}
+
+func TestPlaySessionErrors(t *testing.T) {
+	useMemoryPlayStore(t)
+	c := context.Background()
+	rules, _ := GetGameRules("classic")
+	session, err := NewGameSession(c, "player", "", "frequency", rules, Classic)
+	if err != nil {
+		t.Fatalf("NewGameSession: %v", err)
+	}
+	if _, _, err := PlaySessionRound(c, session.Id, "player", "paper"); err != ErrorNoServerPlay {
+		t.Errorf("PlaySessionRound before the server play: %v, want %v", err, ErrorNoServerPlay)
+	}
+	if _, _, err := PlaySessionRound(c, session.Id, "player", "lizard"); err != ErrorUnknownPlay {
+		t.Errorf("PlaySessionRound of lizard: %v, want %v", err, ErrorUnknownPlay)
+	}
+	if _, err := NextSessionPlay(c, session.Id, "other", func(s *GameSession) Decision {
+		return Decision{Play: "rock"}
+	}); err != ErrorNotYourGame {
+		t.Errorf("NextSessionPlay of another player: %v, want %v", err, ErrorNotYourGame)
+	}
+	if _, _, err := PlaySessionRound(c, session.Id, "", "paper"); err != ErrorNotYourGame {
+		t.Errorf("PlaySessionRound without cookie: %v, want %v", err, ErrorNotYourGame)
+	}
+	if GameErrorStatus(ErrorNotYourGame) != http.StatusForbidden {
+		t.Errorf("GameErrorStatus(%v) = %v, want %v", ErrorNotYourGame, GameErrorStatus(ErrorNotYourGame), http.StatusForbidden)
+	}
+	if _, err := GetGameSession(c, session.Id+1); err != ErrorGameNotFound {
+		t.Errorf("GetGameSession of an unknown game: %v, want %v", err, ErrorGameNotFound)
+	}
+	if _, err := GetGameSession(c, 0); err != ErrorInvalidGameId {
+		t.Errorf("GetGameSession(0): %v, want %v", err, ErrorInvalidGameId)
+	}
+}
+
+func TestPlayedStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		rounds   []string
+		want     string
+	}{
+		{"frequency", nil, "frequency"},
+		{"bandit", []string{"markov", "iocaine", "markov"}, "markov"},
+		{"bandit", []string{"markov", "iocaine"}, "iocaine"},
+		{"bandit", []string{"iocaine", "markov", "markov", "iocaine"}, "iocaine"},
+	}
+	for _, test := range tests {
+		s := &GameSession{Strategy: test.strategy, RoundStrategies: test.rounds}
+		if got := s.PlayedStrategy(); got != test.want {
+			t.Errorf("PlayedStrategy of %v = %v, want %v", test.rounds, got, test.want)
+		}
+	}
+}
+
+func TestStartGameOwner(t *testing.T) {
+	useMemoryPlayStore(t)
+	c := context.Background()
+
+	// The game belongs to the player of the cookie, not of the parameter
+	r := httptest.NewRequest("GET", "/start?rules=best-of-3&id=other", nil)
+	r.AddCookie(&http.Cookie{Name: "ID", Value: "player"})
+	w := httptest.NewRecorder()
+	StartGameHandler(w, r)
+	var session GameSession
+	if err := json.Unmarshal(w.Body.Bytes(), &session); err != nil || session.Id == 0 {
+		t.Fatalf("StartGameHandler = %v %q, want a game", w.Code, w.Body.String())
+	}
+	stored, err := GetGameSession(c, session.Id)
+	if err != nil || stored.CookieId != "player" {
+		t.Errorf("GetGameSession = %+v, %v, want a game of player", stored, err)
+	}
+}
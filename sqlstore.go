@@ -0,0 +1,504 @@
+// Rock Paper Scissors Game on App Engine
+
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/net/context"
+	"strings"
+	"time"
+)
+
+// Migrations of the schema of the SQL play store, applied in order and
+// once, the version of the schema being the number of migrations applied
+var sqlMigrations = []string{
+	// Plays, with the same columns as the GamePlay entities
+	`CREATE TABLE plays (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		cookie_id TEXT NOT NULL DEFAULT '',
+		rule_set TEXT NOT NULL DEFAULT '',
+		strategy TEXT NOT NULL DEFAULT '',
+		opponent TEXT NOT NULL DEFAULT '',
+		current_user_play TEXT NOT NULL,
+		current_server_play TEXT NOT NULL,
+		last_user_plays TEXT NOT NULL DEFAULT '',
+		last_server_plays TEXT NOT NULL DEFAULT '',
+		last3_user_plays TEXT NOT NULL DEFAULT '',
+		last3_server_plays TEXT NOT NULL DEFAULT '',
+		last2_user_plays TEXT NOT NULL DEFAULT '',
+		last2_server_plays TEXT NOT NULL DEFAULT '',
+		commitment TEXT NOT NULL DEFAULT '',
+		nonce TEXT NOT NULL DEFAULT '',
+		created_time DATETIME NOT NULL
+	)`,
+
+	// Contexts queried by the strategies, and history of the players
+	`CREATE INDEX plays_last2 ON plays (last2_user_plays, last2_server_plays, rule_set)`,
+	`CREATE INDEX plays_last3 ON plays (last3_user_plays, last3_server_plays, rule_set)`,
+	`CREATE INDEX plays_cookie_id ON plays (cookie_id, created_time)`,
+	`CREATE INDEX plays_created_time ON plays (created_time)`,
+
+	// Finished games, with the same columns as the GameResult entities
+	`CREATE TABLE games (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		cookie_id TEXT NOT NULL DEFAULT '',
+		opponent TEXT NOT NULL DEFAULT '',
+		rule_set TEXT NOT NULL DEFAULT '',
+		user_plays TEXT NOT NULL DEFAULT '',
+		server_plays TEXT NOT NULL DEFAULT '',
+		winner TEXT NOT NULL DEFAULT '',
+		time DATETIME NOT NULL
+	)`,
+	`CREATE INDEX games_cookie_id ON games (cookie_id, time)`,
+
+	// Game sessions, with the same columns as the GameSession entities,
+	// the rules in JSON
+	`CREATE TABLE game_sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		cookie_id TEXT NOT NULL DEFAULT '',
+		level TEXT NOT NULL DEFAULT '',
+		strategy TEXT NOT NULL DEFAULT '',
+		rules TEXT NOT NULL DEFAULT '',
+		rule_set TEXT NOT NULL DEFAULT '',
+		user_plays TEXT NOT NULL DEFAULT '',
+		server_plays TEXT NOT NULL DEFAULT '',
+		user_wins INTEGER NOT NULL DEFAULT 0,
+		server_wins INTEGER NOT NULL DEFAULT 0,
+		draws INTEGER NOT NULL DEFAULT 0,
+		last_winner TEXT NOT NULL DEFAULT '',
+		winner TEXT NOT NULL DEFAULT '',
+		finished BOOLEAN NOT NULL DEFAULT 0,
+		next_decision TEXT NOT NULL DEFAULT '',
+		next_nonce TEXT NOT NULL DEFAULT '',
+		commitment TEXT NOT NULL DEFAULT '',
+		created_time DATETIME NOT NULL,
+		updated_time DATETIME NOT NULL
+	)`,
+
+	// Results of the strategies against the players, for the bandit
+	`CREATE TABLE strategy_stats (
+		cookie_id TEXT NOT NULL,
+		strategy TEXT NOT NULL,
+		plays INTEGER NOT NULL DEFAULT 0,
+		wins INTEGER NOT NULL DEFAULT 0,
+		draws INTEGER NOT NULL DEFAULT 0,
+		losses INTEGER NOT NULL DEFAULT 0,
+		updated_time DATETIME NOT NULL,
+		PRIMARY KEY (cookie_id, strategy)
+	)`,
+
+	// Strategy which decided the most server plays of the games, and the
+	// one of each round of the game sessions, separated by commas
+	`ALTER TABLE games ADD COLUMN strategy TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE game_sessions ADD COLUMN round_strategies TEXT NOT NULL DEFAULT ''`,
+
+	// Player-vs-player matches, with the same columns as the Match
+	// entities, the rules and the clients of the players in JSON
+	`CREATE TABLE matches (
+		id INTEGER PRIMARY KEY,
+		a_cookie_id TEXT NOT NULL DEFAULT '',
+		a_plays TEXT NOT NULL DEFAULT '',
+		a_wins INTEGER NOT NULL DEFAULT 0,
+		a_ready BOOLEAN NOT NULL DEFAULT 0,
+		a_present BOOLEAN NOT NULL DEFAULT 0,
+		a_move TEXT NOT NULL DEFAULT '',
+		a_client TEXT NOT NULL DEFAULT '',
+		b_cookie_id TEXT NOT NULL DEFAULT '',
+		b_plays TEXT NOT NULL DEFAULT '',
+		b_wins INTEGER NOT NULL DEFAULT 0,
+		b_ready BOOLEAN NOT NULL DEFAULT 0,
+		b_present BOOLEAN NOT NULL DEFAULT 0,
+		b_move TEXT NOT NULL DEFAULT '',
+		b_client TEXT NOT NULL DEFAULT '',
+		rules TEXT NOT NULL DEFAULT '',
+		rule_set TEXT NOT NULL DEFAULT '',
+		round INTEGER NOT NULL DEFAULT 0,
+		draws INTEGER NOT NULL DEFAULT 0,
+		last_winner TEXT NOT NULL DEFAULT '',
+		winner TEXT NOT NULL DEFAULT '',
+		finished BOOLEAN NOT NULL DEFAULT 0,
+		deadline DATETIME NOT NULL,
+		version INTEGER NOT NULL DEFAULT 0,
+		tournament INTEGER NOT NULL DEFAULT 0,
+		tournament_match INTEGER NOT NULL DEFAULT 0,
+		created_time DATETIME NOT NULL,
+		updated_time DATETIME NOT NULL
+	)`,
+}
+
+// Columns of the game sessions table, in the order of sessionFields
+const sqlSessionColumns = `cookie_id, level, strategy, rules, rule_set, user_plays, server_plays,
+	user_wins, server_wins, draws, last_winner, winner, finished,
+	next_decision, next_nonce, commitment, round_strategies, created_time, updated_time`
+
+// Columns of the matches table, in the order of matchFields
+const sqlMatchColumns = `a_cookie_id, a_plays, a_wins, a_ready, a_present, a_move, a_client,
+	b_cookie_id, b_plays, b_wins, b_ready, b_present, b_move, b_client,
+	rules, rule_set, round, draws, last_winner, winner, finished, deadline, version,
+	tournament, tournament_match, created_time, updated_time`
+
+// Store of the plays and games in a SQL database, SQLite for deployments
+// outside of App Engine. It counts all the plays of a context when asked
+// for frequencies, like the counters of the Datastore store.
+type SQLPlayStore struct {
+	DB *sql.DB
+}
+
+// Open the SQLite database of a file, created if needed, and migrate its
+// schema to the last version. Transactions lock the database when they
+// begin, so concurrent updates of a game session wait for each other.
+func OpenSQLitePlayStore(path string) (*SQLPlayStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	s := &SQLPlayStore{DB: db}
+	if err := s.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Apply the migrations of the schema not applied yet, each one in a
+// transaction
+func (s *SQLPlayStore) Migrate() error {
+	if _, err := s.DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_time DATETIME NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	if err := s.DB.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqlMigrations); version++ {
+		tx, err := s.DB.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %v: %v", version+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_time) VALUES (?, ?)`, version+1, time.Now()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLPlayStore) RecordPlay(c context.Context, rs *RuleSet, gp GamePlay) error {
+	if gp.RuleSet == "" {
+		gp.RuleSet = rs.Name
+	}
+	if gp.CreatedTime.IsZero() {
+		gp.CreatedTime = time.Now()
+	}
+	_, err := s.DB.Exec(`INSERT INTO plays (cookie_id, rule_set, strategy, opponent,
+		current_user_play, current_server_play, last_user_plays, last_server_plays,
+		last3_user_plays, last3_server_plays, last2_user_plays, last2_server_plays,
+		commitment, nonce, created_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		gp.CookieId, gp.RuleSet, gp.Strategy, gp.Opponent,
+		gp.CurrentUserPlay, gp.CurrentServerPlay, gp.LastUserPlays, gp.LastServerPlays,
+		gp.Last3UserPlays, gp.Last3ServerPlays, gp.Last2UserPlays, gp.Last2ServerPlays,
+		gp.Commitment, gp.Nonce, gp.CreatedTime.UTC())
+	return err
+}
+
+func (s *SQLPlayStore) ContextFrequencies(c context.Context, rs *RuleSet, userPlays, serverPlays, cookieId string) (map[string]int, int, error) {
+
+	// Plays stored before rule sets existed have no rule set and are
+	// classic ones
+	query := `SELECT current_user_play, COUNT(*) FROM plays
+		WHERE last2_user_plays = ? AND last2_server_plays = ? AND rule_set IN (?, ?)`
+	args := []interface{}{LastNCharacters(userPlays, 2), LastNCharacters(serverPlays, 2), rs.Name, rs.Name}
+	if rs == Classic {
+		args[3] = ""
+	}
+	if cookieId != "" {
+		query += ` AND cookie_id = ?`
+		args = append(args, cookieId)
+	}
+	rows, err := s.DB.Query(query+` GROUP BY current_user_play`, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	freq := make(map[string]int)
+	n := 0
+	for rows.Next() {
+		var play string
+		var count int
+		if err := rows.Scan(&play, &count); err != nil {
+			return nil, 0, err
+		}
+		freq[play] = count
+		n += count
+	}
+	return freq, n, rows.Err()
+}
+
+func (s *SQLPlayStore) PlayerHistory(c context.Context, cookieId string, limit int) ([]GamePlay, error) {
+	rows, err := s.DB.Query(`SELECT cookie_id, rule_set, strategy, opponent,
+		current_user_play, current_server_play, last_user_plays, last_server_plays,
+		last3_user_plays, last3_server_plays, last2_user_plays, last2_server_plays,
+		commitment, nonce, created_time FROM plays
+		WHERE cookie_id = ? ORDER BY created_time DESC, id DESC LIMIT ?`, cookieId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var gamePlays []GamePlay
+	for rows.Next() {
+		var gp GamePlay
+		if err := rows.Scan(&gp.CookieId, &gp.RuleSet, &gp.Strategy, &gp.Opponent,
+			&gp.CurrentUserPlay, &gp.CurrentServerPlay, &gp.LastUserPlays, &gp.LastServerPlays,
+			&gp.Last3UserPlays, &gp.Last3ServerPlays, &gp.Last2UserPlays, &gp.Last2ServerPlays,
+			&gp.Commitment, &gp.Nonce, &gp.CreatedTime); err != nil {
+			return nil, err
+		}
+		gamePlays = append(gamePlays, gp)
+	}
+	return gamePlays, rows.Err()
+}
+
+func (s *SQLPlayStore) RecordGame(c context.Context, result GameResult) error {
+	if result.Time.IsZero() {
+		result.Time = time.Now()
+	}
+	_, err := s.DB.Exec(`INSERT INTO games (cookie_id, opponent, rule_set, user_plays, server_plays, strategy, winner, time)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		result.CookieId, result.Opponent, result.RuleSet, result.UserPlays, result.ServerPlays, result.Strategy, result.Winner, result.Time.UTC())
+	return err
+}
+
+func (s *SQLPlayStore) NewSession(c context.Context, session *GameSession) error {
+	args, err := sessionFields(session)
+	if err != nil {
+		return err
+	}
+	res, err := s.DB.Exec(`INSERT INTO game_sessions (`+sqlSessionColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, args...)
+	if err != nil {
+		return err
+	}
+	session.Id, err = res.LastInsertId()
+	return err
+}
+
+func (s *SQLPlayStore) GetSession(c context.Context, id int64) (*GameSession, error) {
+	return getSQLSession(s.DB, id)
+}
+
+func (s *SQLPlayStore) UpdateSession(c context.Context, id int64, update func(session *GameSession) error) (*GameSession, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	session, err := getSQLSession(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(session); err != nil {
+		return nil, err
+	}
+	args, err := sessionFields(session)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE game_sessions SET (`+sqlSessionColumns+`)
+		= (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) WHERE id = ?`, append(args, id)...); err != nil {
+		return nil, err
+	}
+	return session, tx.Commit()
+}
+
+func (s *SQLPlayStore) StrategyStats(c context.Context, cookieId string) (map[string]StrategyStats, error) {
+	rows, err := s.DB.Query(`SELECT strategy, plays, wins, draws, losses, updated_time
+		FROM strategy_stats WHERE cookie_id = ?`, cookieId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]StrategyStats)
+	for rows.Next() {
+		stats := StrategyStats{CookieId: cookieId}
+		if err := rows.Scan(&stats.Strategy, &stats.Plays, &stats.Wins, &stats.Draws, &stats.Losses, &stats.UpdatedTime); err != nil {
+			return nil, err
+		}
+		result[stats.Strategy] = stats
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLPlayStore) RecordStrategyOutcome(c context.Context, rs *RuleSet, cookieId, strategy, userPlay, serverPlay string) error {
+	outcome := StrategyStats{}
+	outcome.Add(rs, userPlay, serverPlay)
+	_, err := s.DB.Exec(`INSERT INTO strategy_stats (cookie_id, strategy, plays, wins, draws, losses, updated_time)
+		VALUES (?, ?, 1, ?, ?, ?, ?)
+		ON CONFLICT (cookie_id, strategy) DO UPDATE SET plays = plays + 1, wins = wins + excluded.wins,
+		draws = draws + excluded.draws, losses = losses + excluded.losses, updated_time = excluded.updated_time`,
+		cookieId, strategy, outcome.Wins, outcome.Draws, outcome.Losses, outcome.UpdatedTime.UTC())
+	return err
+}
+
+// Return the values of the columns of a game session
+func sessionFields(s *GameSession) ([]interface{}, error) {
+	rules, err := json.Marshal(s.Rules)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{s.CookieId, s.Level, s.Strategy, string(rules), s.RuleSetName, s.UserPlays, s.ServerPlays,
+		s.UserWins, s.ServerWins, s.Draws, s.LastWinner, s.Winner, s.Finished,
+		s.NextDecision, s.NextNonce, s.Commitment, strings.Join(s.RoundStrategies, ","), s.CreatedTime.UTC(), s.UpdatedTime.UTC()}, nil
+}
+
+// Return the game session with this id from the database or from a
+// transaction
+func getSQLSession(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, id int64) (*GameSession, error) {
+	s := &GameSession{Id: id}
+	var rules, roundStrategies string
+	err := q.QueryRow(`SELECT `+sqlSessionColumns+` FROM game_sessions WHERE id = ?`, id).Scan(
+		&s.CookieId, &s.Level, &s.Strategy, &rules, &s.RuleSetName, &s.UserPlays, &s.ServerPlays,
+		&s.UserWins, &s.ServerWins, &s.Draws, &s.LastWinner, &s.Winner, &s.Finished,
+		&s.NextDecision, &s.NextNonce, &s.Commitment, &roundStrategies, &s.CreatedTime, &s.UpdatedTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrorGameNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(rules), &s.Rules); err != nil {
+		return nil, err
+	}
+	if roundStrategies != "" {
+		s.RoundStrategies = strings.Split(roundStrategies, ",")
+	}
+	return s, nil
+}
+
+func (s *SQLPlayStore) StartMatch(c context.Context, match *Match) (*Match, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	m, err := getSQLMatch(tx, match.Id)
+	if err != ErrorMatchNotFound {
+		return m, err
+	}
+	args, err := matchFields(match)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`INSERT INTO matches (id, `+sqlMatchColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		append([]interface{}{match.Id}, args...)...); err != nil {
+		return nil, err
+	}
+	return match, tx.Commit()
+}
+
+func (s *SQLPlayStore) GetMatch(c context.Context, id int64) (*Match, error) {
+	return getSQLMatch(s.DB, id)
+}
+
+func (s *SQLPlayStore) UpdateMatch(c context.Context, id int64, update func(m *Match) (bool, error)) (*Match, bool, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+	m, err := getSQLMatch(tx, id)
+	if err != nil {
+		return nil, false, err
+	}
+	changed, err := update(m)
+	if err != nil || !changed {
+		return m, false, err
+	}
+	args, err := matchFields(m)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := tx.Exec(`UPDATE matches SET (`+sqlMatchColumns+`)
+		= (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) WHERE id = ?`, append(args, id)...); err != nil {
+		return nil, false, err
+	}
+	return m, true, tx.Commit()
+}
+
+// Return the values of the columns of a match
+func matchFields(m *Match) ([]interface{}, error) {
+	rules, err := json.Marshal(m.Rules)
+	if err != nil {
+		return nil, err
+	}
+	clientA, err := json.Marshal(m.A.Client)
+	if err != nil {
+		return nil, err
+	}
+	clientB, err := json.Marshal(m.B.Client)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{m.A.CookieId, m.A.Plays, m.A.Wins, m.A.Ready, m.A.Present, m.A.Move, string(clientA),
+		m.B.CookieId, m.B.Plays, m.B.Wins, m.B.Ready, m.B.Present, m.B.Move, string(clientB),
+		string(rules), m.RuleSetName, m.Round, m.Draws, m.LastWinner, m.Winner, m.Finished, m.Deadline.UTC(), m.Version,
+		m.Tournament, m.TournamentMatch, m.CreatedTime.UTC(), m.UpdatedTime.UTC()}, nil
+}
+
+// Return the match with this id from the database or from a transaction
+func getSQLMatch(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, id int64) (*Match, error) {
+	m := &Match{Id: id}
+	var rules, clientA, clientB string
+	err := q.QueryRow(`SELECT `+sqlMatchColumns+` FROM matches WHERE id = ?`, id).Scan(
+		&m.A.CookieId, &m.A.Plays, &m.A.Wins, &m.A.Ready, &m.A.Present, &m.A.Move, &clientA,
+		&m.B.CookieId, &m.B.Plays, &m.B.Wins, &m.B.Ready, &m.B.Present, &m.B.Move, &clientB,
+		&rules, &m.RuleSetName, &m.Round, &m.Draws, &m.LastWinner, &m.Winner, &m.Finished, &m.Deadline, &m.Version,
+		&m.Tournament, &m.TournamentMatch, &m.CreatedTime, &m.UpdatedTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrorMatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range []struct {
+		value string
+		to    interface{}
+	}{{rules, &m.Rules}, {clientA, &m.A.Client}, {clientB, &m.B.Client}} {
+		if err := json.Unmarshal([]byte(field.value), field.to); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Return the version of the schema of the database, the number of
+// migrations applied
+func (s *SQLPlayStore) Version() (int, error) {
+	var version int
+	err := s.DB.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// Close the database
+func (s *SQLPlayStore) Close() error {
+	return s.DB.Close()
+}
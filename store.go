@@ -0,0 +1,435 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"sync"
+)
+
+// Number of plays returned by default in the history of a player
+const HistorySize = 100
+
+// Storage of the plays, game sessions, matches and finished games of the
+// players
+type PlayStore interface {
+	// Store a play of a rule set
+	RecordPlay(c context.Context, rs *RuleSet, gamePlay GamePlay) error
+	// Return the frequency histogram of the next user play/move in the
+	// previous plays of the rule set with the same last 2 user and server
+	// plays, and the number of plays found. Only plays of cookieId are
+	// used if not "".
+	ContextFrequencies(c context.Context, rs *RuleSet, userPlays, serverPlays, cookieId string) (map[string]int, int, error)
+	// Return at most limit plays of a player, the most recent first
+	PlayerHistory(c context.Context, cookieId string, limit int) ([]GamePlay, error)
+	// Store a finished game
+	RecordGame(c context.Context, result GameResult) error
+	// Store a new game session, setting its id
+	NewSession(c context.Context, s *GameSession) error
+	// Return the game session with this id, ErrorGameNotFound if none
+	GetSession(c context.Context, id int64) (*GameSession, error)
+	// Update the game session with this id atomically, and return it
+	UpdateSession(c context.Context, id int64, update func(s *GameSession) error) (*GameSession, error)
+	// Return the results of the strategies played against a player, by
+	// strategy name
+	StrategyStats(c context.Context, cookieId string) (map[string]StrategyStats, error)
+	// Count the outcome of a play/move of a strategy against a player,
+	// possibly later
+	RecordStrategyOutcome(c context.Context, rs *RuleSet, cookieId, strategy, userPlay, serverPlay string) error
+	// Store a new player-vs-player match under its id, unless it already
+	// exists, and return the stored match
+	StartMatch(c context.Context, m *Match) (*Match, error)
+	// Return the match with this id, ErrorMatchNotFound if none
+	GetMatch(c context.Context, id int64) (*Match, error)
+	// Update the match with this id atomically, storing it only if
+	// update returns true, and return it and whether it was stored
+	UpdateMatch(c context.Context, id int64, update func(m *Match) (bool, error)) (*Match, bool, error)
+}
+
+// Store of the plays and games of the application
+var playStore PlayStore = DatastorePlayStore{}
+
+// Store of the plays and games in Datastore, in GamePlay, GameSession
+// and GameResult entities. Plays are counted by context in sharded
+// counters (see counters.go).
+type DatastorePlayStore struct{}
+
+func (DatastorePlayStore) RecordPlay(c context.Context, rs *RuleSet, gamePlay GamePlay) error {
+	if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "GamePlay", nil), &gamePlay); err != nil {
+		return err
+	}
+	if err := countPlayLater.Call(c, rs.Name, gamePlay); err != nil {
+		logger.Errorf(c, "Error while counting play: %v", err)
+	}
+	return nil
+}
+
+func (s DatastorePlayStore) ContextFrequencies(c context.Context, rs *RuleSet, userPlays, serverPlays, cookieId string) (map[string]int, int, error) {
+	counter, ok, err := GetPlayCounter(c, rs, userPlays, serverPlays, cookieId)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ok {
+		return counter.Frequencies(rs), counter.Total, nil
+	}
+
+	// Plays recorded before the counters existed are only found by
+	// querying them
+	return s.QueryContextFrequencies(c, rs, userPlays, serverPlays, cookieId)
+}
+
+// Return the frequency histogram of the next user play/move in at most
+// 100 previous plays of the rule set with the same last 2 user and
+// server plays, and the number of plays found. Only plays of cookieId
+// are used if not "".
+func (DatastorePlayStore) QueryContextFrequencies(c context.Context, rs *RuleSet, userPlays, serverPlays, cookieId string) (map[string]int, int, error) {
+	var gamePlays []GamePlay
+	q := datastore.NewQuery("GamePlay").
+		Filter("Last2UserPlays =", LastNCharacters(userPlays, 2)).
+		Filter("Last2ServerPlays =", LastNCharacters(serverPlays, 2))
+	if cookieId != "" {
+		q = q.Filter("CookieId =", cookieId)
+	}
+
+	// Plays stored before rule sets existed have no rule set and are
+	// classic ones, so classic plays are filtered after the query
+	if rs != Classic {
+		q = q.Filter("RuleSet =", rs.Name)
+	}
+	if _, err := q.Limit(100).GetAll(c, &gamePlays); err != nil {
+		return nil, 0, err
+	}
+	freq := make(map[string]int)
+	n := 0
+	for _, gp := range gamePlays {
+		if !gp.InRuleSet(rs) {
+			continue
+		}
+		freq[gp.CurrentUserPlay]++
+		n++
+	}
+	return freq, n, nil
+}
+
+func (DatastorePlayStore) PlayerHistory(c context.Context, cookieId string, limit int) ([]GamePlay, error) {
+	var gamePlays []GamePlay
+	q := datastore.NewQuery("GamePlay").Filter("CookieId =", cookieId).Order("-CreatedTime").Limit(limit)
+	if _, err := q.GetAll(c, &gamePlays); err != nil {
+		return nil, err
+	}
+	return gamePlays, nil
+}
+
+func (DatastorePlayStore) RecordGame(c context.Context, result GameResult) error {
+	_, err := datastore.Put(c, datastore.NewIncompleteKey(c, "GameResult", nil), &result)
+	return err
+}
+
+func (DatastorePlayStore) NewSession(c context.Context, s *GameSession) error {
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "GameSession", nil), s)
+	if err != nil {
+		return err
+	}
+	s.Id = key.IntID()
+	return nil
+}
+
+func (DatastorePlayStore) GetSession(c context.Context, id int64) (*GameSession, error) {
+	s := &GameSession{}
+	err := datastore.Get(c, datastore.NewKey(c, "GameSession", "", id, nil), s)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrorGameNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Id = id
+	return s, nil
+}
+
+func (d DatastorePlayStore) UpdateSession(c context.Context, id int64, update func(s *GameSession) error) (*GameSession, error) {
+	var session *GameSession
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		s, err := d.GetSession(tc, id)
+		if err != nil {
+			return err
+		}
+		if err := update(s); err != nil {
+			return err
+		}
+		if _, err := datastore.Put(tc, datastore.NewKey(tc, "GameSession", "", id, nil), s); err != nil {
+			return err
+		}
+		session = s
+		return nil
+	}, nil)
+	return session, err
+}
+
+func (DatastorePlayStore) StrategyStats(c context.Context, cookieId string) (map[string]StrategyStats, error) {
+	return GetStrategyStats(c, cookieId)
+}
+
+// Count the outcome in a task, so the plays don't wait for the
+// transaction on the statistics
+func (DatastorePlayStore) RecordStrategyOutcome(c context.Context, rs *RuleSet, cookieId, strategy, userPlay, serverPlay string) error {
+	return recordStrategyOutcomeLater.Call(c, rs.Name, cookieId, strategy, userPlay, serverPlay)
+}
+
+func (d DatastorePlayStore) StartMatch(c context.Context, match *Match) (*Match, error) {
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		m, err := d.GetMatch(tc, match.Id)
+		if err != ErrorMatchNotFound {
+			if err == nil {
+				match = m
+			}
+			return err
+		}
+		_, err = datastore.Put(tc, datastore.NewKey(tc, "Match", "", match.Id, nil), match)
+		return err
+	}, nil)
+	return match, err
+}
+
+func (DatastorePlayStore) GetMatch(c context.Context, id int64) (*Match, error) {
+	m := &Match{}
+	err := datastore.Get(c, datastore.NewKey(c, "Match", "", id, nil), m)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrorMatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.Id = id
+	return m, nil
+}
+
+func (d DatastorePlayStore) UpdateMatch(c context.Context, id int64, update func(m *Match) (bool, error)) (*Match, bool, error) {
+	var match *Match
+	var updated bool
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		m, err := d.GetMatch(tc, id)
+		if err != nil {
+			return err
+		}
+		match, updated = m, false
+		changed, err := update(m)
+		if err != nil || !changed {
+			return err
+		}
+		if _, err := datastore.Put(tc, datastore.NewKey(tc, "Match", "", id, nil), m); err != nil {
+			return err
+		}
+		updated = true
+		return nil
+	}, nil)
+	return match, updated, err
+}
+
+// Return true if the play is of a rule set, plays stored before rule
+// sets existed being classic ones
+func (gp GamePlay) InRuleSet(rs *RuleSet) bool {
+	if gp.RuleSet == "" {
+		return rs == Classic
+	}
+	return gp.RuleSet == rs.Name
+}
+
+// Store of the plays and games in memory, for tests and commands running
+// outside of App Engine. It keeps every play, counted by context of all
+// players and of each player, and indexed by player, so reading the
+// frequencies or the history of a player doesn't depend on the number
+// of plays stored.
+type MemoryPlayStore struct {
+	mutex    sync.Mutex
+	plays    []GamePlay
+	contexts map[memoryContext]map[string]int
+	players  map[string][]int
+	games    []GameResult
+	stats    map[string]map[string]StrategyStats
+
+	// Sessions and matches have their own lock, held while updating
+	// one, as the updates decide the next server play from the plays
+	sessionMutex sync.Mutex
+	sessions     map[int64]GameSession
+	matches      map[int64]Match
+}
+
+// Return a new empty store in memory
+func NewMemoryPlayStore() *MemoryPlayStore {
+	return &MemoryPlayStore{
+		contexts: make(map[memoryContext]map[string]int),
+		players:  make(map[string][]int),
+		stats:    make(map[string]map[string]StrategyStats),
+		sessions: make(map[int64]GameSession),
+		matches:  make(map[int64]Match),
+	}
+}
+
+// Context of the plays counted by the memory store: the last 2 user and
+// server plays of a rule set, of all players if CookieId is ""
+type memoryContext struct {
+	RuleSet     string
+	CookieId    string
+	UserPlays   string
+	ServerPlays string
+}
+
+func (m *MemoryPlayStore) RecordPlay(c context.Context, rs *RuleSet, gamePlay GamePlay) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if gamePlay.RuleSet == "" {
+		gamePlay.RuleSet = rs.Name
+	}
+	cookieIds := []string{""}
+	if gamePlay.CookieId != "" {
+		cookieIds = append(cookieIds, gamePlay.CookieId)
+	}
+	for _, cookieId := range cookieIds {
+		key := memoryContext{gamePlay.RuleSet, cookieId, gamePlay.Last2UserPlays, gamePlay.Last2ServerPlays}
+		if m.contexts[key] == nil {
+			m.contexts[key] = make(map[string]int)
+		}
+		m.contexts[key][gamePlay.CurrentUserPlay]++
+	}
+	m.players[gamePlay.CookieId] = append(m.players[gamePlay.CookieId], len(m.plays))
+	m.plays = append(m.plays, gamePlay)
+	return nil
+}
+
+func (m *MemoryPlayStore) ContextFrequencies(c context.Context, rs *RuleSet, userPlays, serverPlays, cookieId string) (map[string]int, int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := memoryContext{rs.Name, cookieId, LastNCharacters(userPlays, 2), LastNCharacters(serverPlays, 2)}
+	freq := make(map[string]int)
+	n := 0
+	for play, count := range m.contexts[key] {
+		freq[play] = count
+		n += count
+	}
+	return freq, n, nil
+}
+
+func (m *MemoryPlayStore) PlayerHistory(c context.Context, cookieId string, limit int) ([]GamePlay, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var gamePlays []GamePlay
+	indexes := m.players[cookieId]
+	for i := len(indexes) - 1; i >= 0 && len(gamePlays) < limit; i-- {
+		gamePlays = append(gamePlays, m.plays[indexes[i]])
+	}
+	return gamePlays, nil
+}
+
+func (m *MemoryPlayStore) RecordGame(c context.Context, result GameResult) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.games = append(m.games, result)
+	return nil
+}
+
+func (m *MemoryPlayStore) NewSession(c context.Context, s *GameSession) error {
+	m.sessionMutex.Lock()
+	defer m.sessionMutex.Unlock()
+	s.Id = int64(len(m.sessions) + 1)
+	m.sessions[s.Id] = storedSession(*s)
+	return nil
+}
+
+func (m *MemoryPlayStore) GetSession(c context.Context, id int64) (*GameSession, error) {
+	m.sessionMutex.Lock()
+	defer m.sessionMutex.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrorGameNotFound
+	}
+	return &s, nil
+}
+
+// Update a game session holding the lock of the sessions, so updates
+// are serialized like Datastore transactions
+func (m *MemoryPlayStore) UpdateSession(c context.Context, id int64, update func(s *GameSession) error) (*GameSession, error) {
+	m.sessionMutex.Lock()
+	defer m.sessionMutex.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrorGameNotFound
+	}
+	if err := update(&s); err != nil {
+		return nil, err
+	}
+	m.sessions[id] = storedSession(s)
+	return &s, nil
+}
+
+func (m *MemoryPlayStore) StrategyStats(c context.Context, cookieId string) (map[string]StrategyStats, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	result := make(map[string]StrategyStats)
+	for strategy, stats := range m.stats[cookieId] {
+		result[strategy] = stats
+	}
+	return result, nil
+}
+
+func (m *MemoryPlayStore) RecordStrategyOutcome(c context.Context, rs *RuleSet, cookieId, strategy, userPlay, serverPlay string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.stats[cookieId] == nil {
+		m.stats[cookieId] = make(map[string]StrategyStats)
+	}
+	stats := m.stats[cookieId][strategy]
+	stats.CookieId, stats.Strategy = cookieId, strategy
+	stats.Add(rs, userPlay, serverPlay)
+	m.stats[cookieId][strategy] = stats
+	return nil
+}
+
+func (m *MemoryPlayStore) StartMatch(c context.Context, match *Match) (*Match, error) {
+	m.sessionMutex.Lock()
+	defer m.sessionMutex.Unlock()
+	if stored, ok := m.matches[match.Id]; ok {
+		return &stored, nil
+	}
+	m.matches[match.Id] = *match
+	return match, nil
+}
+
+func (m *MemoryPlayStore) GetMatch(c context.Context, id int64) (*Match, error) {
+	m.sessionMutex.Lock()
+	defer m.sessionMutex.Unlock()
+	match, ok := m.matches[id]
+	if !ok {
+		return nil, ErrorMatchNotFound
+	}
+	return &match, nil
+}
+
+func (m *MemoryPlayStore) UpdateMatch(c context.Context, id int64, update func(m *Match) (bool, error)) (*Match, bool, error) {
+	m.sessionMutex.Lock()
+	defer m.sessionMutex.Unlock()
+	match, ok := m.matches[id]
+	if !ok {
+		return nil, false, ErrorMatchNotFound
+	}
+	changed, err := update(&match)
+	if err != nil || !changed {
+		return &match, false, err
+	}
+	m.matches[id] = match
+	return &match, true, nil
+}
+
+// Return a game session as stored, without its reveal of the last round
+// which is only returned by the update playing it
+func storedSession(s GameSession) GameSession {
+	s.Reveal = nil
+	return s
+}
+
+// Return the finished games stored, the oldest first
+func (m *MemoryPlayStore) Games() []GameResult {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]GameResult(nil), m.games...)
+}
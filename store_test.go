@@ -0,0 +1,211 @@
+// Rock Paper Scissors Game on App Engine
+
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"golang.org/x/net/context"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Record the same plays of several players and rule sets in each store,
+// one play a second from start
+func recordTestPlays(t *testing.T, c context.Context, stores []PlayStore) []GamePlay {
+	random := rand.New(rand.NewSource(1))
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var gamePlays []GamePlay
+	for _, name := range []string{"classic", "rpsls"} {
+		rs, err := GetRuleSet(name)
+		if err != nil {
+			t.Fatalf("GetRuleSet(%v): %v", name, err)
+		}
+		for _, cookieId := range []string{"alice", "bob", ""} {
+			userPlays, serverPlays := "", ""
+			for i := 0; i < 40; i++ {
+				userPlays += rs.Codes[random.Intn(len(rs.Codes))]
+				serverPlays += rs.Codes[random.Intn(len(rs.Codes))]
+				gamePlay := NewGamePlay(userPlays, serverPlays)
+				gamePlay.CookieId = cookieId
+				gamePlay.Strategy = "frequency"
+				gamePlay.Commitment = Commit(gamePlay.CurrentServerPlay, "nonce")
+				gamePlay.Nonce = "nonce"
+				gamePlay.CreatedTime = start.Add(time.Duration(len(gamePlays)) * time.Second)
+				for _, store := range stores {
+					if err := store.RecordPlay(c, rs, gamePlay); err != nil {
+						t.Fatalf("RecordPlay: %v", err)
+					}
+				}
+				gamePlay.RuleSet = rs.Name
+				gamePlays = append(gamePlays, gamePlay)
+			}
+		}
+	}
+	return gamePlays
+}
+
+func TestPlayStores(t *testing.T) {
+	c := context.Background()
+	sqlStore, err := OpenSQLitePlayStore(filepath.Join(t.TempDir(), "rps.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLitePlayStore: %v", err)
+	}
+	defer sqlStore.Close()
+	stores := []PlayStore{NewMemoryPlayStore(), sqlStore}
+	names := []string{"memory", "sqlite"}
+	gamePlays := recordTestPlays(t, c, stores)
+
+	// Frequencies of every context played, and of one never played, by
+	// rule set, of all players or of one
+	for _, rs := range ruleSets {
+		contexts := map[[2]string]bool{{"zz", "zz"}: true}
+		for _, gp := range gamePlays {
+			contexts[[2]string{gp.LastUserPlays, gp.LastServerPlays}] = true
+		}
+		for played := range contexts {
+			for _, cookieId := range []string{"", "alice", "bob", "carol"} {
+				want, wantN, err := stores[0].ContextFrequencies(c, rs, played[0], played[1], cookieId)
+				if err != nil {
+					t.Fatalf("%v: ContextFrequencies: %v", names[0], err)
+				}
+				for i, store := range stores[1:] {
+					got, n, err := store.ContextFrequencies(c, rs, played[0], played[1], cookieId)
+					if err != nil {
+						t.Fatalf("%v: ContextFrequencies: %v", names[i+1], err)
+					}
+					if n != wantN || !reflect.DeepEqual(got, want) {
+						t.Errorf("%v: ContextFrequencies(%v, %q, %q, %q) = %v, %v, want %v, %v from %v",
+							names[i+1], rs.Name, played[0], played[1], cookieId, got, n, want, wantN, names[0])
+					}
+				}
+			}
+		}
+	}
+
+	// Histories of the players, the most recent play first
+	for _, cookieId := range []string{"alice", "bob", "carol"} {
+		for _, limit := range []int{1, 10, 1000} {
+			want, err := stores[0].PlayerHistory(c, cookieId, limit)
+			if err != nil {
+				t.Fatalf("%v: PlayerHistory: %v", names[0], err)
+			}
+			if cookieId != "carol" && len(want) != limit && len(want) != 80 {
+				t.Errorf("%v: PlayerHistory(%q, %v) returned %v plays", names[0], cookieId, limit, len(want))
+			}
+			for i, store := range stores[1:] {
+				got, err := store.PlayerHistory(c, cookieId, limit)
+				if err != nil {
+					t.Fatalf("%v: PlayerHistory: %v", names[i+1], err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%v: PlayerHistory(%q, %v) = %+v, want %+v from %v", names[i+1], cookieId, limit, got, want, names[0])
+				}
+			}
+		}
+	}
+}
+
+func TestSQLMatches(t *testing.T) {
+	store, err := OpenSQLitePlayStore(filepath.Join(t.TempDir(), "rps.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLitePlayStore: %v", err)
+	}
+	defer store.Close()
+	saved := playStore
+	playStore = store
+	defer func() {
+		playStore = saved
+	}()
+	useNoEventSink(t)
+	playTestMatch(t)
+}
+
+// Check the frequencies and histories of a few known plays in each store,
+// alice and bob playing in turn, and an anonymous player once
+func TestPlayStoreResults(t *testing.T) {
+	c := context.Background()
+	sqlStore, err := OpenSQLitePlayStore(filepath.Join(t.TempDir(), "rps.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLitePlayStore: %v", err)
+	}
+	defer sqlStore.Close()
+	rpsls, err := GetRuleSet("rpsls")
+	if err != nil {
+		t.Fatalf("GetRuleSet(rpsls): %v", err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	games := []struct{ cookieId, userPlays, serverPlays string }{
+		{"alice", "rpr", "sss"},
+		{"bob", "rpp", "sss"},
+		{"", "s", "r"},
+	}
+
+	for name, store := range map[string]PlayStore{"memory": NewMemoryPlayStore(), "sqlite": sqlStore} {
+		n := 0
+		for round := 1; round <= 3; round++ {
+			for _, game := range games {
+				if len(game.userPlays) < round {
+					continue
+				}
+				gamePlay := NewGamePlay(game.userPlays[:round], game.serverPlays[:round])
+				gamePlay.CookieId = game.cookieId
+				gamePlay.CreatedTime = start.Add(time.Duration(n) * time.Second)
+				if err := store.RecordPlay(c, Classic, gamePlay); err != nil {
+					t.Fatalf("%v: RecordPlay: %v", name, err)
+				}
+				n++
+			}
+		}
+
+		for _, test := range []struct {
+			rs                               *RuleSet
+			userPlays, serverPlays, cookieId string
+			want                             map[string]int
+			wantN                            int
+		}{
+			{Classic, "", "", "", map[string]int{"r": 2, "s": 1}, 3},
+			{Classic, "", "", "alice", map[string]int{"r": 1}, 1},
+			{Classic, "r", "s", "", map[string]int{"p": 2}, 2},
+			{Classic, "rp", "ss", "", map[string]int{"r": 1, "p": 1}, 2},
+			{Classic, "srp", "sss", "bob", map[string]int{"p": 1}, 1},
+			{Classic, "pp", "ss", "", map[string]int{}, 0},
+			{rpsls, "", "", "", map[string]int{}, 0},
+		} {
+			got, gotN, err := store.ContextFrequencies(c, test.rs, test.userPlays, test.serverPlays, test.cookieId)
+			if err != nil {
+				t.Fatalf("%v: ContextFrequencies: %v", name, err)
+			}
+			if gotN != test.wantN || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%v: ContextFrequencies(%v, %q, %q, %q) = %v, %v, want %v, %v", name,
+					test.rs.Name, test.userPlays, test.serverPlays, test.cookieId, got, gotN, test.want, test.wantN)
+			}
+		}
+
+		// Plays 0, 3 and 5 of alice, the most recent first
+		for _, limit := range []int{2, 10} {
+			history, err := store.PlayerHistory(c, "alice", limit)
+			if err != nil {
+				t.Fatalf("%v: PlayerHistory: %v", name, err)
+			}
+			var plays string
+			var seconds []int
+			for _, gamePlay := range history {
+				plays += gamePlay.CurrentUserPlay
+				seconds = append(seconds, int(gamePlay.CreatedTime.Sub(start)/time.Second))
+			}
+			wantPlays, wantSeconds := "rpr", []int{5, 3, 0}
+			if limit < 3 {
+				wantPlays, wantSeconds = "rp", []int{5, 3}
+			}
+			if plays != wantPlays || !reflect.DeepEqual(seconds, wantSeconds) {
+				t.Errorf("%v: PlayerHistory(alice, %v) played %q at %v s, want %q at %v s",
+					name, limit, plays, seconds, wantPlays, wantSeconds)
+			}
+		}
+	}
+}
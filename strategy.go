@@ -0,0 +1,172 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"golang.org/x/net/context"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// Name of the strategy used when none is requested
+const DefaultStrategyName = "frequency"
+
+// Information available to a strategy to decide the next server play:
+// the rule set of the game, the player cookie id and the compressed
+// plays of the user and of the server in the current game (for example
+// "rps" and "ppr")
+type Round struct {
+	RuleSet     *RuleSet `json:"-"`
+	CookieId    string   `json:"cookie_id,omitempty"`
+	UserPlays   string   `json:"user_plays"`
+	ServerPlays string   `json:"server_plays"`
+}
+
+// Decision of a strategy for the next server play/move, with the
+// reasoning behind it: the predicted distribution of the user play,
+// the number of samples it is based on, whether the play was picked at
+// random, and what the strategy followed (e.g. the iocaine predictor)
+type Decision struct {
+	Play         string       `json:"play"`
+	Confidence   float64      `json:"confidence"`
+	Strategy     string       `json:"strategy,omitempty"`
+	Distribution Distribution `json:"distribution,omitempty"`
+	Samples      int          `json:"samples"`
+	Random       bool         `json:"random"`
+	Reason       string       `json:"reason,omitempty"`
+}
+
+// Interface implemented by every bot. Given a round, a strategy returns
+// the next server play and how confident it is in that play (between
+// 0 and 1).
+type Strategy interface {
+	Name() string
+	Play(c context.Context, round Round) (Decision, error)
+}
+
+// Registry of available strategies by name
+var strategies = make(map[string]Strategy)
+
+// Register a strategy so it can be selected by name.
+// Meant to be called from init() functions.
+func RegisterStrategy(s Strategy) {
+	strategies[s.Name()] = s
+}
+
+// Return the strategy registered under name, or the default
+// strategy if name is unknown
+func GetStrategy(name string) Strategy {
+	if s, ok := strategies[name]; ok {
+		return s
+	}
+	return strategies[DefaultStrategyName]
+}
+
+// Return the sorted names of all registered strategies
+func StrategyNames() []string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Return the name of the strategy to use for a request: the "strategy"
+// parameter if any, then the STRATEGY environment variable (set in
+// app.yaml), then the default strategy
+func StrategyName(r *http.Request) string {
+	if name := r.FormValue("strategy"); name != "" {
+		return name
+	}
+	if name := os.Getenv("STRATEGY"); name != "" {
+		return name
+	}
+	return DefaultStrategyName
+}
+
+// Probabilities of the next user play/move, keyed by move code
+// (e.g. "r", "p" or "s")
+type Distribution map[string]float64
+
+// Return the uniform distribution over all plays/moves
+func (rs *RuleSet) UniformDistribution() Distribution {
+	d := make(Distribution)
+	for _, code := range rs.Codes {
+		d[code] = 1 / float64(len(rs.Codes))
+	}
+	return d
+}
+
+// Return the distribution of a histogram of move codes.
+// Return the uniform distribution if the histogram is empty.
+func (rs *RuleSet) NewDistribution(freq map[string]int) Distribution {
+	total := 0
+	for _, code := range rs.Codes {
+		total += freq[code]
+	}
+	if total == 0 {
+		return rs.UniformDistribution()
+	}
+	d := make(Distribution)
+	for _, code := range rs.Codes {
+		d[code] = float64(freq[code]) / float64(total)
+	}
+	return d
+}
+
+// Return the mixture w*a + (1-w)*b of two distributions
+func (rs *RuleSet) Blend(a, b Distribution, w float64) Distribution {
+	d := make(Distribution)
+	for _, code := range rs.Codes {
+		d[code] = w*a[code] + (1-w)*b[code]
+	}
+	return d
+}
+
+// Return the play/move with the best expected score against a
+// distribution of user plays, i.e. the probability of beating the user
+// minus the probability of being beaten. The confidence is the
+// probability of beating the user.
+func (rs *RuleSet) BestResponse(d Distribution) Decision {
+	best := Decision{}
+	bestScore := 0.0
+	for _, i := range rand.Perm(len(rs.Moves)) {
+		win, lose := 0.0, 0.0
+		for _, code := range rs.Codes {
+			if rs.Beats(rs.Codes[i], code) {
+				win += d[code]
+			} else if rs.Beats(code, rs.Codes[i]) {
+				lose += d[code]
+			}
+		}
+		if best.Play == "" || win-lose > bestScore {
+			best = Decision{Play: rs.Moves[i], Confidence: win, Distribution: d}
+			bestScore = win - lose
+		}
+	}
+	return best
+}
+
+// Return a random play/move, with the confidence of a random guess
+func (rs *RuleSet) RandomDecision() Decision {
+	return Decision{
+		Play:         rs.Moves[rand.Intn(len(rs.Moves))],
+		Confidence:   1 / float64(len(rs.Moves)),
+		Distribution: rs.UniformDistribution(),
+		Random:       true,
+	}
+}
+
+// Return the most likely move code of a distribution, the first one in
+// order of moves in case of equality. Return "" if d is empty.
+func (rs *RuleSet) MostLikely(d Distribution) string {
+	best := ""
+	for _, code := range rs.Codes {
+		if prob, ok := d[code]; ok && (best == "" || prob > d[best]) {
+			best = code
+		}
+	}
+	return best
+}
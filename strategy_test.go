@@ -0,0 +1,114 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"golang.org/x/net/context"
+	"testing"
+)
+
+// Store the plays of a game in the play store, one per round
+func recordTestGame(t *testing.T, c context.Context, rs *RuleSet, cookieId, userPlays, serverPlays string) {
+	for i := 1; i <= len(userPlays); i++ {
+		gamePlay := NewGamePlay(userPlays[:i], serverPlays[:i])
+		gamePlay.CookieId = cookieId
+		gamePlay.RuleSet = rs.Name
+		if err := playStore.RecordPlay(c, rs, gamePlay); err != nil {
+			t.Fatalf("RecordPlay: %v", err)
+		}
+	}
+}
+
+func TestFrequencyStrategy(t *testing.T) {
+	useMemoryPlayStore(t)
+	c := context.Background()
+
+	// Without plays, the strategy plays at random
+	decision, err := GetStrategy("frequency").Play(c, Round{RuleSet: Classic, UserPlays: "rr", ServerPlays: "ps"})
+	if err != nil || !decision.Random {
+		t.Fatalf("Play without plays = %+v, %v, want random", decision, err)
+	}
+
+	// After rock then rock against paper then scissor, players mostly
+	// played scissor
+	recordTestGame(t, c, Classic, "a", "rrs", "pss")
+	recordTestGame(t, c, Classic, "b", "rrs", "psr")
+	recordTestGame(t, c, Classic, "c", "rrp", "psr")
+	decision, err = GetStrategy("frequency").Play(c, Round{RuleSet: Classic, UserPlays: "rr", ServerPlays: "ps"})
+	if err != nil || decision.Play != "rock" || decision.Samples != 3 {
+		t.Errorf("Play = %+v, %v, want rock on 3 samples", decision, err)
+	}
+}
+
+func TestIocaineStrategy(t *testing.T) {
+	c := context.Background()
+
+	// A user cycling through the moves is predicted by the history
+	decision, err := GetStrategy("iocaine").Play(c, Round{RuleSet: Classic, UserPlays: "rpsrpsrps", ServerPlays: "rrrrrrrrr"})
+	if err != nil {
+		t.Fatalf("Play: %v", err)
+	}
+	if decision.Play != "paper" || decision.Reason == "" || decision.Distribution["r"] != decision.Confidence {
+		t.Errorf("Play = %+v, want paper against the predicted rock", decision)
+	}
+	total := 0.0
+	for _, p := range decision.Distribution {
+		total += p
+	}
+	if total < 0.999 || total > 1.001 {
+		t.Errorf("Distribution %v sums to %v, want 1", decision.Distribution, total)
+	}
+}
+
+func TestBanditOutcomes(t *testing.T) {
+	store := useMemoryPlayStore(t)
+	c := context.Background()
+	bandit := GetStrategy("bandit").(BanditStrategy)
+
+	// Outcomes are only recorded for the arms of the bandit playing a
+	// known player
+	rules, _ := GetGameRules("classic")
+	session := &GameSession{CookieId: "player", Strategy: "bandit", Rules: rules, RuleSetName: "classic"}
+	plays := []GamePlay{
+		{CurrentUserPlay: "r", CurrentServerPlay: "p", Strategy: "markov"},
+		{CurrentUserPlay: "p", CurrentServerPlay: "p", Strategy: "markov"},
+		{CurrentUserPlay: "s", CurrentServerPlay: "p", Strategy: "iocaine"},
+		{CurrentUserPlay: "s", CurrentServerPlay: "p", Strategy: "easy"},
+	}
+	for _, gamePlay := range plays {
+		if err := RecordBanditOutcome(c, session, gamePlay); err != nil {
+			t.Fatalf("RecordBanditOutcome: %v", err)
+		}
+	}
+	anonymous := &GameSession{Strategy: "bandit", Rules: rules}
+	if err := RecordBanditOutcome(c, anonymous, plays[0]); err != nil {
+		t.Fatalf("RecordBanditOutcome: %v", err)
+	}
+	notBandit := &GameSession{CookieId: "player", Strategy: "markov", Rules: rules}
+	if err := RecordBanditOutcome(c, notBandit, plays[0]); err != nil {
+		t.Fatalf("RecordBanditOutcome: %v", err)
+	}
+
+	stats, err := store.StrategyStats(c, "player")
+	if err != nil {
+		t.Fatalf("StrategyStats: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Errorf("StrategyStats = %+v, want markov and iocaine", stats)
+	}
+	if s := stats["markov"]; s.Plays != 2 || s.Wins != 1 || s.Draws != 1 || s.Reward() != 0.75 {
+		t.Errorf("markov stats %+v, want 1 win and 1 draw", s)
+	}
+	if s := stats["iocaine"]; s.Plays != 1 || s.Losses != 1 {
+		t.Errorf("iocaine stats %+v, want 1 loss", s)
+	}
+	if stats, _ := store.StrategyStats(c, ""); len(stats) != 0 {
+		t.Errorf("StrategyStats of anonymous players = %+v, want none", stats)
+	}
+
+	// Arms never played are picked first
+	for i := 0; i < 10; i++ {
+		if arm := bandit.Select(stats); arm != "frequency" && arm != "personal" {
+			t.Errorf("Select = %v, want an arm never played", arm)
+		}
+	}
+}
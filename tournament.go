@@ -0,0 +1,768 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Errors from the tournament functions
+var (
+	ErrorTournamentNotFound  = errors.New("Tournament not found")
+	ErrorInvalidTournamentId = errors.New("Invalid tournament id")
+	ErrorUnknownFormat       = errors.New("Unknown tournament format, use single, double or round-robin")
+	ErrorTournamentStarted   = errors.New("Tournament already started")
+	ErrorTournamentNotReady  = errors.New("Tournament is not running")
+	ErrorNotEnoughPlayers    = errors.New("A tournament needs at least 2 players")
+	ErrorNotOwner            = errors.New("Only the owner of the tournament can do this")
+	ErrorInvalidResult       = errors.New("Invalid match result")
+)
+
+// Formats of tournaments
+const (
+	SingleElimination = "single"
+	DoubleElimination = "double"
+	RoundRobin        = "round-robin"
+)
+
+// Brackets of tournament matches. In double elimination, the winner of
+// the losers bracket has to beat the winner of the winners bracket twice:
+// the reset match is only played if the final was lost by the latter.
+const (
+	WinnersBracket    = "winners"
+	LosersBracket     = "losers"
+	FinalBracket      = "final"
+	ResetBracket      = "reset"
+	RoundRobinBracket = "round-robin"
+)
+
+// States of a tournament
+const (
+	TournamentRegistration = "registration"
+	TournamentRunning      = "running"
+	TournamentFinished     = "finished"
+)
+
+// Special seeds of the players of a tournament match: a player not known
+// yet, a bye (no player, the opponent advances), and the winner of a
+// drawn round robin match
+const (
+	NoSeed   = 0
+	ByeSeed  = -1
+	DrawSeed = -2
+)
+
+// Player registered in a tournament, by cookie id and by Google account
+// if signed in, so the player can come back from another browser
+type TournamentPlayer struct {
+	Seed     int     `json:"seed"`
+	Name     string  `json:"name"`
+	Rating   float64 `json:"rating"`
+	CookieId string  `json:"-"`
+	Account  string  `json:"-"`
+}
+
+// Match of a tournament between the players of seeds A and B. The winner
+// and the loser go to the given slot ("a" or "b") of their next match
+// (index + 1, 0 if none). MatchId is the player-vs-player match played.
+type TournamentMatch struct {
+	Bracket    string `json:"bracket"`
+	Round      int    `json:"round"`
+	A          int    `json:"a"`
+	B          int    `json:"b"`
+	Winner     int    `json:"winner"`
+	MatchId    int64  `json:"match_id,omitempty"`
+	WinnerTo   int    `json:"-" datastore:",noindex"`
+	WinnerSlot string `json:"-" datastore:",noindex"`
+	LoserTo    int    `json:"-" datastore:",noindex"`
+	LoserSlot  string `json:"-" datastore:",noindex"`
+}
+
+// Results of a player in a tournament: 1 point per win, half a point
+// per draw
+type Standing struct {
+	Seed   int     `json:"seed"`
+	Name   string  `json:"name"`
+	Wins   int     `json:"wins"`
+	Draws  int     `json:"draws"`
+	Losses int     `json:"losses"`
+	Points float64 `json:"points"`
+}
+
+// Structure to store a tournament in Datastore with its bracket. Players
+// register until the owner starts the tournament, the matches are then
+// scheduled as soon as both their players are known, and the bracket
+// advances with their results.
+type Tournament struct {
+	Id          int64              `json:"id" datastore:"-"`
+	Name        string             `json:"name"`
+	Format      string             `json:"format"`
+	Owner       string             `json:"-"`
+	Rules       GameRules          `json:"rules"`
+	RuleSetName string             `json:"rule_set" datastore:"RuleSet"`
+	Status      string             `json:"status"`
+	Players     []TournamentPlayer `json:"players"`
+	Matches     []TournamentMatch  `json:"matches"`
+	Winner      int                `json:"winner,omitempty"`
+	CreatedTime time.Time          `json:"created_time"`
+	UpdatedTime time.Time          `json:"updated_time"`
+	Standings   []Standing         `json:"standings,omitempty" datastore:"-"`
+	You         int                `json:"you,omitempty" datastore:"-"`
+}
+
+// Return the seed of a player in the tournament, NoSeed if not registered
+func (t *Tournament) Seed(cookieId string) int {
+	for _, p := range t.Players {
+		if cookieId != "" && p.CookieId == cookieId {
+			return p.Seed
+		}
+	}
+	return NoSeed
+}
+
+// Return the tournament as seen by a player
+func (t *Tournament) View(cookieId string) *Tournament {
+	t.You = t.Seed(cookieId)
+	t.Standings = t.Results()
+	return t
+}
+
+// Add a match to the tournament and return its index
+func (t *Tournament) addMatch(bracket string, round, a, b int) int {
+	t.Matches = append(t.Matches, TournamentMatch{Bracket: bracket, Round: round, A: a, B: b})
+	return len(t.Matches) - 1
+}
+
+// Send the winner of a match to the slot of another match
+func (t *Tournament) winnerTo(from, to int, slot string) {
+	t.Matches[from].WinnerTo, t.Matches[from].WinnerSlot = to+1, slot
+}
+
+// Send the loser of a match to the slot of another match
+func (t *Tournament) loserTo(from, to int, slot string) {
+	t.Matches[from].LoserTo, t.Matches[from].LoserSlot = to+1, slot
+}
+
+// Return the seeds in the order of the first round of an elimination
+// bracket of size players (a power of 2), so the best seeds meet last:
+// 1, 8, 4, 5, 2, 7, 3, 6 for 8 players
+func SeedOrder(size int) []int {
+	order := []int{1}
+	for len(order) < size {
+		n := 2*len(order) + 1
+		next := make([]int, 0, 2*len(order))
+		for _, seed := range order {
+			next = append(next, seed, n-seed)
+		}
+		order = next
+	}
+	return order
+}
+
+// Build the winners bracket of an elimination tournament, seeds missing
+// to fill a power of 2 being byes, and return its rounds of matches
+func (t *Tournament) buildWinnersBracket() [][]int {
+	n := len(t.Players)
+	size := 2
+	for size < n {
+		size *= 2
+	}
+	order := SeedOrder(size)
+	var round []int
+	for i := 0; i < size; i += 2 {
+		a, b := order[i], order[i+1]
+		if a > n {
+			a = ByeSeed
+		}
+		if b > n {
+			b = ByeSeed
+		}
+		round = append(round, t.addMatch(WinnersBracket, 1, a, b))
+	}
+	rounds := [][]int{round}
+	for len(round) > 1 {
+		var next []int
+		for i := 0; i < len(round); i += 2 {
+			m := t.addMatch(WinnersBracket, len(rounds)+1, NoSeed, NoSeed)
+			t.winnerTo(round[i], m, "a")
+			t.winnerTo(round[i+1], m, "b")
+			next = append(next, m)
+		}
+		round = next
+		rounds = append(rounds, round)
+	}
+	return rounds
+}
+
+// Build the losers bracket of a double elimination tournament, and the
+// final and reset matches. Losers of the first winners round play each
+// other, then each round the losers of the next winners round play the
+// survivors of the losers bracket, which play each other in between.
+func (t *Tournament) buildLosersBracket(wb [][]int) {
+	final := len(wb) - 1
+	var lb []int
+	if final > 0 {
+		for i := 0; i < len(wb[0]); i += 2 {
+			m := t.addMatch(LosersBracket, 1, NoSeed, NoSeed)
+			t.loserTo(wb[0][i], m, "a")
+			t.loserTo(wb[0][i+1], m, "b")
+			lb = append(lb, m)
+		}
+	}
+	round := 1
+	for r := 1; r < len(wb); r++ {
+		// Losers drop in reverse order, to delay rematches
+		round++
+		var minor []int
+		drop := wb[r]
+		for j := range lb {
+			m := t.addMatch(LosersBracket, round, NoSeed, NoSeed)
+			t.winnerTo(lb[j], m, "a")
+			t.loserTo(drop[len(drop)-1-j], m, "b")
+			minor = append(minor, m)
+		}
+		lb = minor
+		if len(lb) > 1 {
+			round++
+			var major []int
+			for j := 0; j < len(lb); j += 2 {
+				m := t.addMatch(LosersBracket, round, NoSeed, NoSeed)
+				t.winnerTo(lb[j], m, "a")
+				t.winnerTo(lb[j+1], m, "b")
+				major = append(major, m)
+			}
+			lb = major
+		}
+	}
+
+	m := t.addMatch(FinalBracket, 1, NoSeed, NoSeed)
+	t.winnerTo(wb[final][0], m, "a")
+	if len(lb) > 0 {
+		t.winnerTo(lb[0], m, "b")
+	} else {
+		t.loserTo(wb[final][0], m, "b")
+	}
+	reset := t.addMatch(ResetBracket, 1, NoSeed, NoSeed)
+	t.winnerTo(m, reset, "a")
+}
+
+// Build the matches of a round robin tournament, every player meeting
+// every other once, by the circle method
+func (t *Tournament) buildRoundRobin() {
+	seeds := make([]int, 0, len(t.Players)+1)
+	for _, p := range t.Players {
+		seeds = append(seeds, p.Seed)
+	}
+	if len(seeds)%2 == 1 {
+		seeds = append(seeds, ByeSeed)
+	}
+	n := len(seeds)
+	for round := 1; round < n; round++ {
+		for i := 0; i < n/2; i++ {
+			a, b := seeds[i], seeds[n-1-i]
+			if a != ByeSeed && b != ByeSeed {
+				t.addMatch(RoundRobinBracket, round, a, b)
+			}
+		}
+		seeds = append([]int{seeds[0], seeds[n-1]}, seeds[1:n-1]...)
+	}
+}
+
+// Build the bracket of the tournament for its registered players, seeded
+// by rating, and start it
+func (t *Tournament) Start() error {
+	if t.Status != TournamentRegistration {
+		return ErrorTournamentStarted
+	}
+	if len(t.Players) < 2 {
+		return ErrorNotEnoughPlayers
+	}
+	sort.SliceStable(t.Players, func(i, j int) bool {
+		return t.Players[i].Rating > t.Players[j].Rating
+	})
+	for i := range t.Players {
+		t.Players[i].Seed = i + 1
+	}
+
+	t.Matches = nil
+	switch t.Format {
+	case SingleElimination:
+		t.buildWinnersBracket()
+	case DoubleElimination:
+		t.buildLosersBracket(t.buildWinnersBracket())
+	case RoundRobin:
+		t.buildRoundRobin()
+	default:
+		return ErrorUnknownFormat
+	}
+	t.Status = TournamentRunning
+	t.Advance()
+	return nil
+}
+
+// Put a player in a slot of a match, and return true if it changed
+func (t *Tournament) fill(i int, slot string, seed int) bool {
+	m := &t.Matches[i]
+	p := &m.A
+	if slot == "b" {
+		p = &m.B
+	}
+	if *p == seed {
+		return false
+	}
+	*p = seed
+	return true
+}
+
+// Advance the bracket: decide the matches with a bye, send the winners
+// and losers of decided matches to their next matches, schedule the
+// matches whose players are known, and finish the tournament once every
+// match is decided
+func (t *Tournament) Advance() {
+	for changed := true; changed; {
+		changed = false
+		for i := range t.Matches {
+			m := &t.Matches[i]
+			if m.Winner == NoSeed && m.A != NoSeed && m.B != NoSeed && (m.A == ByeSeed || m.B == ByeSeed) {
+				m.Winner = m.A
+				if m.A == ByeSeed {
+					m.Winner = m.B
+				}
+				changed = true
+			}
+			if m.Winner == NoSeed || m.Winner == DrawSeed {
+				continue
+			}
+			loser := m.A
+			if m.Winner == m.A {
+				loser = m.B
+			}
+
+			// The reset match is a bye for the winner of the winners
+			// bracket if it won the final, and a rematch otherwise
+			if m.Bracket == FinalBracket {
+				rematch := m.B
+				if m.Winner == m.A {
+					rematch = ByeSeed
+				}
+				changed = t.fill(m.WinnerTo-1, "a", m.A) || changed
+				changed = t.fill(m.WinnerTo-1, "b", rematch) || changed
+				continue
+			}
+			if m.WinnerTo > 0 {
+				changed = t.fill(m.WinnerTo-1, m.WinnerSlot, m.Winner) || changed
+			}
+			if m.LoserTo > 0 {
+				changed = t.fill(m.LoserTo-1, m.LoserSlot, loser) || changed
+			}
+		}
+	}
+
+	// Schedule the matches ready to be played
+	finished := true
+	for i := range t.Matches {
+		m := &t.Matches[i]
+		if m.Winner != NoSeed {
+			continue
+		}
+		finished = false
+		if m.A > 0 && m.B > 0 && m.MatchId == 0 {
+			m.MatchId = NewPairingId()
+		}
+	}
+	if !finished || t.Status != TournamentRunning {
+		return
+	}
+
+	t.Status = TournamentFinished
+	if t.Format == RoundRobin {
+		t.Winner = t.Results()[0].Seed
+	} else {
+		t.Winner = t.Matches[len(t.Matches)-1].Winner
+	}
+}
+
+// Return the standings of the players, by points then seed
+func (t *Tournament) Results() []Standing {
+	standings := make([]Standing, len(t.Players))
+	for i, p := range t.Players {
+		standings[i] = Standing{Seed: p.Seed, Name: p.Name}
+	}
+	get := func(seed int) *Standing {
+		if seed < 1 || seed > len(standings) {
+			return nil
+		}
+		for i := range standings {
+			if standings[i].Seed == seed {
+				return &standings[i]
+			}
+		}
+		return nil
+	}
+	for _, m := range t.Matches {
+		a, b := get(m.A), get(m.B)
+		if a == nil || b == nil || m.Winner == NoSeed {
+			continue
+		}
+		switch m.Winner {
+		case m.A:
+			a.Wins++
+			b.Losses++
+		case m.B:
+			b.Wins++
+			a.Losses++
+		case DrawSeed:
+			a.Draws++
+			b.Draws++
+		}
+	}
+	for i := range standings {
+		standings[i].Points = float64(standings[i].Wins) + float64(standings[i].Draws)/2
+	}
+	sort.SliceStable(standings, func(i, j int) bool {
+		if standings[i].Points != standings[j].Points {
+			return standings[i].Points > standings[j].Points
+		}
+		return standings[i].Seed < standings[j].Seed
+	})
+	return standings
+}
+
+// Record the winner of a tournament match from the winner of the match
+// played for it ("a", "b" or "draw"). A drawn elimination match is
+// played again.
+func (t *Tournament) Record(i int, matchId int64, winner string) error {
+	if t.Status != TournamentRunning {
+		return ErrorTournamentNotReady
+	}
+	if i < 0 || i >= len(t.Matches) {
+		return ErrorInvalidResult
+	}
+	m := &t.Matches[i]
+	if m.MatchId != matchId || m.Winner != NoSeed {
+		return ErrorInvalidResult
+	}
+	switch {
+	case winner == "a":
+		m.Winner = m.A
+	case winner == "b":
+		m.Winner = m.B
+	case t.Format == RoundRobin:
+		m.Winner = DrawSeed
+	default:
+		m.MatchId = 0
+	}
+	t.Advance()
+	return nil
+}
+
+// Return the player-vs-player match to play for a tournament match
+func (t *Tournament) NewMatch(i int) *Match {
+	tm := t.Matches[i]
+	a, b := t.Players[tm.A-1], t.Players[tm.B-1]
+	ruleSet, err := GetRuleSet(t.RuleSetName)
+	if err != nil {
+		ruleSet = Classic
+	}
+	m := NewMatch(Pairing{
+		Id:      tm.MatchId,
+		Players: []Ticket{{CookieId: a.CookieId}, {CookieId: b.CookieId}},
+	}, t.Rules, ruleSet)
+	m.A.Present, m.B.Present = false, false
+	m.Deadline = time.Time{}
+	m.Tournament, m.TournamentMatch = t.Id, i
+	return m
+}
+
+// Create the tournament of an owner, open for registration
+func NewTournament(c context.Context, owner, name, format string, rules GameRules, ruleSet *RuleSet) (*Tournament, error) {
+	switch format {
+	case SingleElimination, DoubleElimination, RoundRobin:
+	default:
+		return nil, ErrorUnknownFormat
+	}
+	t := &Tournament{
+		Name:        name,
+		Format:      format,
+		Owner:       owner,
+		Rules:       rules,
+		RuleSetName: ruleSet.Name,
+		Status:      TournamentRegistration,
+		CreatedTime: time.Now(),
+		UpdatedTime: time.Now(),
+	}
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Tournament", nil), t)
+	if err != nil {
+		return nil, err
+	}
+	t.Id = key.IntID()
+	return t, nil
+}
+
+// Return the tournament with this id
+func GetTournament(c context.Context, id int64) (*Tournament, error) {
+	if id <= 0 {
+		return nil, ErrorInvalidTournamentId
+	}
+	t := &Tournament{}
+	err := datastore.Get(c, datastore.NewKey(c, "Tournament", "", id, nil), t)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrorTournamentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Id = id
+	return t, nil
+}
+
+// Update the tournament with this id in a transaction, then create the
+// player-vs-player matches of the matches ready to be played
+func UpdateTournament(c context.Context, id int64, update func(t *Tournament) error) (*Tournament, error) {
+	var tournament *Tournament
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		t, err := GetTournament(tc, id)
+		if err != nil {
+			return err
+		}
+		if err := update(t); err != nil {
+			return err
+		}
+		t.UpdatedTime = time.Now()
+		if _, err := datastore.Put(tc, datastore.NewKey(tc, "Tournament", "", id, nil), t); err != nil {
+			return err
+		}
+		tournament = t
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, m := range tournament.Matches {
+		if m.MatchId != 0 && m.Winner == NoSeed {
+			if _, err := StartMatch(c, tournament.NewMatch(i)); err != nil {
+				return tournament, err
+			}
+		}
+	}
+	return tournament, nil
+}
+
+// Register a player in a tournament, or update its cookie id and name if
+// already registered with the same Google account
+func RegisterTournamentPlayer(c context.Context, id int64, cookieId, account, name string) (*Tournament, error) {
+	return UpdateTournament(c, id, func(t *Tournament) error {
+		if t.Status != TournamentRegistration {
+			return ErrorTournamentStarted
+		}
+		rating, err := GetRating(c, PlayerRating, cookieId)
+		if err != nil {
+			return err
+		}
+		for i, p := range t.Players {
+			if p.CookieId == cookieId || (account != "" && p.Account == account) {
+				t.Players[i].CookieId, t.Players[i].Name, t.Players[i].Rating = cookieId, name, rating.Rating
+				return nil
+			}
+		}
+		if name == "" {
+			name = fmt.Sprintf("Player %v", len(t.Players)+1)
+		}
+		t.Players = append(t.Players, TournamentPlayer{
+			Seed:     len(t.Players) + 1,
+			Name:     name,
+			Rating:   rating.Rating,
+			CookieId: cookieId,
+			Account:  account,
+		})
+		return nil
+	})
+}
+
+// Record in its tournament the result of a finished player-vs-player
+// match played for it
+func RecordTournamentResult(c context.Context, m *Match) error {
+	_, err := UpdateTournament(c, m.Tournament, func(t *Tournament) error {
+		return t.Record(m.TournamentMatch, m.Id, m.Winner)
+	})
+	return err
+}
+
+// Return the error status code for errors of the tournament functions
+func TournamentErrorStatus(err error) int {
+	switch err {
+	case ErrorTournamentNotFound:
+		return http.StatusNotFound
+	case ErrorNotOwner:
+		return http.StatusForbidden
+	case ErrorInvalidTournamentId, ErrorUnknownFormat, ErrorTournamentStarted, ErrorTournamentNotReady,
+		ErrorNotEnoughPlayers, ErrorInvalidResult, ErrorMissingCookie:
+		return http.StatusBadRequest
+	}
+	return GameErrorStatus(err)
+}
+
+// Return the tournament id of a request (t parameter)
+func RequestTournamentId(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(r.FormValue("t"), 10, 64)
+	return id
+}
+
+// Return true if the player (ID cookie) owns the tournament, or is
+// signed in as an administrator of the application
+func IsTournamentOwner(c context.Context, r *http.Request, t *Tournament) bool {
+	cookieId := RequestCookieId(r)
+	return (cookieId != "" && cookieId == t.Owner) || user.IsAdmin(c)
+}
+
+// Write a tournament as seen by the player (ID cookie) in JSON in
+// HTTP response, or the error
+func writeTournament(c context.Context, w http.ResponseWriter, r *http.Request, t *Tournament, err error) {
+	if err != nil {
+		logger.Errorf(c, "Error with tournament %v: %v", r.FormValue("t"), err)
+		http.Error(w, "Error: "+err.Error(), TournamentErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, ToJSON(t.View(RequestCookieId(r))))
+}
+
+// Provide a tournament (t parameter) with its bracket and standings
+// Return the tournament in JSON in HTTP response
+func TournamentHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Tournament Handler")
+
+	t, err := GetTournament(c, RequestTournamentId(r))
+	writeTournament(c, w, r, t, err)
+
+}
+
+// Create a tournament (name parameter) of a format (single, double or
+// round-robin parameter) with the requested game rules and rule set,
+// owned by the player (ID cookie)
+// Return the tournament in JSON in HTTP response
+func CreateTournamentHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Create Tournament Handler")
+
+	cookieId := RequestCookieId(r)
+	if cookieId == "" {
+		writeTournament(c, w, r, nil, ErrorMissingCookie)
+		return
+	}
+
+	rules, err := RequestGameRules(r)
+	if err != nil {
+		writeTournament(c, w, r, nil, err)
+		return
+	}
+
+	ruleSet, err := RequestRuleSet(r)
+	if err != nil {
+		writeTournament(c, w, r, nil, err)
+		return
+	}
+
+	t, err := NewTournament(c, cookieId, r.FormValue("name"), r.FormValue("format"), rules, ruleSet)
+	writeTournament(c, w, r, t, err)
+
+}
+
+// Register the player (ID cookie) in a tournament (t parameter) under
+// a name (name parameter), with the Google account of the player if
+// signed in
+// Return the tournament in JSON in HTTP response
+func RegisterTournamentHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Register Tournament Handler")
+
+	cookieId := RequestCookieId(r)
+	if cookieId == "" {
+		writeTournament(c, w, r, nil, ErrorMissingCookie)
+		return
+	}
+
+	account := ""
+	if u := user.Current(c); u != nil {
+		account = u.Email
+	}
+
+	name, err := CleanDisplayName(r.FormValue("name"))
+	if err != nil {
+		writeTournament(c, w, r, nil, err)
+		return
+	}
+
+	t, err := RegisterTournamentPlayer(c, RequestTournamentId(r), cookieId, account, name)
+	writeTournament(c, w, r, t, err)
+
+}
+
+// Close the registrations of a tournament (t parameter) and schedule its
+// first matches, for its owner (ID cookie) only
+// Return the tournament in JSON in HTTP response
+func StartTournamentHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Start Tournament Handler")
+
+	t, err := UpdateTournament(c, RequestTournamentId(r), func(t *Tournament) error {
+		if !IsTournamentOwner(c, r, t) {
+			return ErrorNotOwner
+		}
+		return t.Start()
+	})
+	writeTournament(c, w, r, t, err)
+
+}
+
+// Record the winner (winner parameter, a seed) of a match (match
+// parameter, an index) of a tournament (t parameter) played outside of
+// the game, for the owner (ID cookie) only
+// Return the tournament in JSON in HTTP response
+func ReportTournamentHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	logger.Infof(c, ">>>> Report Tournament Handler")
+
+	i, _ := strconv.Atoi(r.FormValue("match"))
+	winner, _ := strconv.Atoi(r.FormValue("winner"))
+	t, err := UpdateTournament(c, RequestTournamentId(r), func(t *Tournament) error {
+		if !IsTournamentOwner(c, r, t) {
+			return ErrorNotOwner
+		}
+		if i < 0 || i >= len(t.Matches) {
+			return ErrorInvalidResult
+		}
+		m := t.Matches[i]
+		switch {
+		case winner > 0 && winner == m.A:
+			return t.Record(i, m.MatchId, "a")
+		case winner > 0 && winner == m.B:
+			return t.Record(i, m.MatchId, "b")
+		case winner == DrawSeed && t.Format == RoundRobin:
+			return t.Record(i, m.MatchId, "draw")
+		}
+		return ErrorInvalidResult
+	})
+	writeTournament(c, w, r, t, err)
+
+}
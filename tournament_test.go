@@ -0,0 +1,225 @@
+// Rock Paper Scissors Game on App Engine
+package main
+
+import (
+	"testing"
+)
+
+// Return a tournament in registration with n players, rated so that
+// player i gets seed i+1
+func newTestTournament(format string, n int) *Tournament {
+	t := &Tournament{Format: format, Status: TournamentRegistration}
+	for i := 0; i < n; i++ {
+		t.Players = append(t.Players, TournamentPlayer{Rating: float64(2000 - i)})
+	}
+	return t
+}
+
+// Play the scheduled matches of a tournament until it is finished, the
+// winner of each match ("a", "b" or "draw") being picked from the match
+func playTournament(t *testing.T, tr *Tournament, pick func(m TournamentMatch) string) {
+	for n := 0; tr.Status == TournamentRunning; n++ {
+		if n > 1000 {
+			t.Fatalf("Tournament not finished after %v matches", n)
+		}
+		played := false
+		for i, m := range tr.Matches {
+			if m.MatchId != 0 && m.Winner == NoSeed {
+				if err := tr.Record(i, m.MatchId, pick(m)); err != nil {
+					t.Fatalf("Record(%v): %v", i, err)
+				}
+				played = true
+				break
+			}
+		}
+		if !played {
+			t.Fatalf("No match scheduled in running tournament: %+v", tr.Matches)
+		}
+	}
+}
+
+// Winners of the matches: the best seed, or the worst one
+func bestSeedWins(m TournamentMatch) string {
+	if m.A < m.B {
+		return "a"
+	}
+	return "b"
+}
+
+func worstSeedWins(m TournamentMatch) string {
+	if m.A > m.B {
+		return "a"
+	}
+	return "b"
+}
+
+// Return the match of a bracket, nil if none
+func bracketMatch(tr *Tournament, bracket string) *TournamentMatch {
+	for i := range tr.Matches {
+		if tr.Matches[i].Bracket == bracket {
+			return &tr.Matches[i]
+		}
+	}
+	return nil
+}
+
+func TestSeedOrder(t *testing.T) {
+	want := []int{1, 8, 4, 5, 2, 7, 3, 6}
+	got := SeedOrder(8)
+	if len(got) != len(want) {
+		t.Fatalf("SeedOrder(8) = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("SeedOrder(8) = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSingleElimination(t *testing.T) {
+	for n := 2; n <= 13; n++ {
+		for _, worst := range []bool{false, true} {
+			tr := newTestTournament(SingleElimination, n)
+			if err := tr.Start(); err != nil {
+				t.Fatalf("n=%v: Start: %v", n, err)
+			}
+			pick, want := bestSeedWins, 1
+			if worst {
+				pick, want = worstSeedWins, n
+			}
+			playTournament(t, tr, pick)
+			if tr.Winner != want {
+				t.Errorf("n=%v worst=%v: winner %v, want %v", n, worst, tr.Winner, want)
+			}
+			for _, s := range tr.Results() {
+				if s.Seed != tr.Winner && s.Losses != 1 {
+					t.Errorf("n=%v worst=%v: seed %v lost %v matches, want 1", n, worst, s.Seed, s.Losses)
+				}
+			}
+		}
+	}
+}
+
+func TestDoubleElimination(t *testing.T) {
+	for n := 2; n <= 13; n++ {
+		tr := newTestTournament(DoubleElimination, n)
+		if err := tr.Start(); err != nil {
+			t.Fatalf("n=%v: Start: %v", n, err)
+		}
+		playTournament(t, tr, bestSeedWins)
+		if tr.Winner != 1 {
+			t.Errorf("n=%v: winner %v, want 1", n, tr.Winner)
+		}
+
+		// The winner of the winners bracket won the final, so the reset
+		// match is a bye
+		if reset := bracketMatch(tr, ResetBracket); reset.B != ByeSeed || reset.MatchId != 0 {
+			t.Errorf("n=%v: reset match %+v, want a bye", n, *reset)
+		}
+		for _, s := range tr.Results() {
+			if s.Seed != tr.Winner && s.Losses != 2 {
+				t.Errorf("n=%v: seed %v lost %v matches, want 2", n, s.Seed, s.Losses)
+			}
+		}
+	}
+}
+
+func TestDoubleEliminationReset(t *testing.T) {
+	for n := 2; n <= 13; n++ {
+		for _, resetWinner := range []string{"a", "b"} {
+			tr := newTestTournament(DoubleElimination, n)
+			if err := tr.Start(); err != nil {
+				t.Fatalf("n=%v: Start: %v", n, err)
+			}
+
+			// Seed 1 wins the winners bracket and seed 2 the losers one,
+			// then seed 2 wins the final, forcing the reset match
+			var final TournamentMatch
+			playTournament(t, tr, func(m TournamentMatch) string {
+				switch m.Bracket {
+				case FinalBracket:
+					final = m
+					return "b"
+				case ResetBracket:
+					if m.A != final.A || m.B != final.B {
+						t.Errorf("n=%v: reset match %v-%v, want %v-%v", n, m.A, m.B, final.A, final.B)
+					}
+					return resetWinner
+				}
+				return bestSeedWins(m)
+			})
+			if final.A != 1 || final.B != 2 {
+				t.Errorf("n=%v: final %v-%v, want 1-2", n, final.A, final.B)
+			}
+			reset := bracketMatch(tr, ResetBracket)
+			if reset.MatchId == 0 {
+				t.Errorf("n=%v: reset match not played", n)
+			}
+			want := 1
+			if resetWinner == "b" {
+				want = 2
+			}
+			if tr.Winner != want {
+				t.Errorf("n=%v reset won by %v: winner %v, want %v", n, resetWinner, tr.Winner, want)
+			}
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	for n := 2; n <= 9; n++ {
+		tr := newTestTournament(RoundRobin, n)
+		if err := tr.Start(); err != nil {
+			t.Fatalf("n=%v: Start: %v", n, err)
+		}
+		if len(tr.Matches) != n*(n-1)/2 {
+			t.Errorf("n=%v: %v matches, want %v", n, len(tr.Matches), n*(n-1)/2)
+		}
+		met := make(map[[2]int]bool)
+		for _, m := range tr.Matches {
+			pair := [2]int{m.A, m.B}
+			if m.A > m.B {
+				pair = [2]int{m.B, m.A}
+			}
+			if met[pair] {
+				t.Errorf("n=%v: %v and %v meet twice", n, m.A, m.B)
+			}
+			met[pair] = true
+		}
+
+		// Seed 2 draws against seed 1 and beats the others, seed 1
+		// losing against the others
+		playTournament(t, tr, func(m TournamentMatch) string {
+			switch {
+			case (m.A == 1 && m.B == 2) || (m.A == 2 && m.B == 1):
+				return "draw"
+			case m.A == 2 || m.B == 1:
+				return "a"
+			case m.B == 2 || m.A == 1:
+				return "b"
+			}
+			return bestSeedWins(m)
+		})
+		standings := tr.Results()
+		if n > 2 && (tr.Winner != 2 || standings[0].Points != float64(n-2)+0.5) {
+			t.Errorf("n=%v: winner %v with %v points, want 2 with %v", n, tr.Winner, standings[0].Points, float64(n-2)+0.5)
+		}
+		if n == 2 && tr.Winner != 1 {
+			t.Errorf("n=2: winner %v of a draw, want the best seed 1", tr.Winner)
+		}
+	}
+}
+
+func TestStartErrors(t *testing.T) {
+	if err := newTestTournament(SingleElimination, 1).Start(); err != ErrorNotEnoughPlayers {
+		t.Errorf("Start with 1 player: %v, want %v", err, ErrorNotEnoughPlayers)
+	}
+	if err := newTestTournament("swiss", 4).Start(); err != ErrorUnknownFormat {
+		t.Errorf("Start of unknown format: %v, want %v", err, ErrorUnknownFormat)
+	}
+	tr := newTestTournament(SingleElimination, 4)
+	tr.Start()
+	if err := tr.Start(); err != ErrorTournamentStarted {
+		t.Errorf("Start twice: %v, want %v", err, ErrorTournamentStarted)
+	}
+}
@@ -3,7 +3,6 @@ package main
 
 import (
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
 	"html/template"
 	"net/http"
 	"strings"
@@ -17,10 +16,10 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 
 	c := appengine.NewContext(r)
 
-	log.Infof(c, ">>>> Home Handler")
+	logger.Infof(c, ">>>> Home Handler")
 
 	// Check if game is a Facebook canvas
-	log.Debugf(c, "Referer: %v")
+	logger.Debugf(c, "Referer: %v", r.Referer())
 	isFacebook := ""
 	if strings.Contains(r.Referer(), "apps.facebook.com") && r.Method == "POST" {
 		isFacebook = "1"
@@ -31,11 +30,17 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Render home page
 	if err := pageTemplate.Execute(w, template.FuncMap{
-		"Version":    appengine.VersionID(c),
-		"CookieID":   cookieId,
-		"isFacebook": isFacebook,
+		"Version":      appengine.VersionID(c),
+		"CookieID":     cookieId,
+		"isFacebook":   isFacebook,
+		"Difficulties": difficulties,
+		"Difficulty":   DefaultDifficultyName,
+		"Rules":        gameRules,
+		"RulesName":    ConfiguredRulesName(),
+		"RuleSets":     ruleSets,
+		"RuleSetName":  ConfiguredRuleSetName(),
 	}); err != nil {
-		log.Errorf(c, "Error with pageTemplate: %v", err)
+		logger.Errorf(c, "Error with pageTemplate: %v", err)
 		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}